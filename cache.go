@@ -0,0 +1,109 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CacheHeaderSize is the size of the header of a cache file: the data size followed by the data hash
+const CacheHeaderSize = 8 + sha256.Size
+
+// Decompress decompresses an embedded book
+func Decompress(compressed []byte) ([]byte, error) {
+	return io.ReadAll(bzip2.NewReader(bytes.NewReader(compressed)))
+}
+
+// OpenBook opens a decompressing stream of an embedded book
+func OpenBook(name string) (io.Reader, error) {
+	compressed, err := Text.ReadFile(fmt.Sprintf("books/%s", name))
+	if err != nil {
+		return nil, err
+	}
+	return bzip2.NewReader(bytes.NewReader(compressed)), nil
+}
+
+// ReadBook reads and decompresses an embedded book, using the cache directory if it isn't empty
+func ReadBook(name, cache string) ([]byte, error) {
+	compressed, err := Text.ReadFile(fmt.Sprintf("books/%s", name))
+	if err != nil {
+		return nil, err
+	}
+	if cache == "" {
+		return Decompress(compressed)
+	}
+
+	sum := sha256.Sum256(compressed)
+	path := filepath.Join(cache, fmt.Sprintf("%s.%s", name, hex.EncodeToString(sum[:8])))
+	if data, err := readCache(path); err == nil {
+		return data, nil
+	}
+
+	data, err := Decompress(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCache(path, data); err != nil {
+		fmt.Fprintln(os.Stderr, "cache:", err)
+	}
+	return data, nil
+}
+
+// readCache reads a cache file and validates its size and hash
+func readCache(path string) ([]byte, error) {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(input) < CacheHeaderSize {
+		return nil, errors.New("cache file is truncated")
+	}
+	size, data := binary.LittleEndian.Uint64(input[:8]), input[CacheHeaderSize:]
+	if uint64(len(data)) != size {
+		return nil, errors.New("cache file has the wrong size")
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], input[8:CacheHeaderSize]) {
+		return nil, errors.New("cache file has the wrong hash")
+	}
+	return data, nil
+}
+
+// writeCache atomically writes a cache file
+func writeCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	output, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(output.Name())
+
+	header := make([]byte, CacheHeaderSize)
+	binary.LittleEndian.PutUint64(header[:8], uint64(len(data)))
+	sum := sha256.Sum256(data)
+	copy(header[8:], sum[:])
+	if _, err := output.Write(header); err != nil {
+		output.Close()
+		return err
+	}
+	if _, err := output.Write(data); err != nil {
+		output.Close()
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	return os.Rename(output.Name(), path)
+}
@@ -0,0 +1,334 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/pointlander/gradient/tf64"
+)
+
+// CheckpointMagic identifies a checkpoint file
+const CheckpointMagic = "AUTO"
+
+const (
+	// FormatFloat64 stores full precision weights and the optimizer states
+	FormatFloat64 = iota
+	// FormatInt8 stores int8 quantized weights with a scale factor per tensor and no optimizer states
+	FormatInt8
+)
+
+// QuantizationError is the error introduced by quantizing the weights
+type QuantizationError struct {
+	Max  float64
+	Mean float64
+}
+
+// String formats the quantization error
+func (q QuantizationError) String() string {
+	return fmt.Sprintf("max=%g mean=%g", q.Max, q.Mean)
+}
+
+// SaveAutos saves the auto encoders to a checkpoint, quantize selects the format: "" or "int8"
+func SaveAutos(path string, autos []Auto, quantize string) (QuantizationError, error) {
+	var quantization QuantizationError
+	format := uint32(FormatFloat64)
+	switch quantize {
+	case "":
+	case "int8":
+		format = FormatInt8
+	default:
+		return quantization, fmt.Errorf("unknown quantization %q", quantize)
+	}
+
+	output, err := os.Create(path)
+	if err != nil {
+		return quantization, err
+	}
+	defer output.Close()
+	writer := bufio.NewWriter(output)
+	write := func(data any) {
+		if err == nil {
+			err = binary.Write(writer, binary.LittleEndian, data)
+		}
+	}
+
+	write([]byte(CheckpointMagic))
+	write(format)
+	write(uint32(len(autos)))
+	count := 0
+	for _, a := range autos {
+		write(a.Symbol)
+		write(uint64(a.Iteration))
+		write(uint32(len(a.Set.Weights)))
+		for _, w := range a.Set.Weights {
+			write(uint32(len(w.N)))
+			write([]byte(w.N))
+			write(uint32(len(w.S)))
+			for _, s := range w.S {
+				write(uint32(s))
+			}
+			write(uint32(len(w.X)))
+			switch format {
+			case FormatFloat64:
+				write(w.X)
+				write(uint32(len(w.States)))
+				for _, state := range w.States {
+					write(state)
+				}
+			case FormatInt8:
+				max := 0.0
+				for _, value := range w.X {
+					if a := math.Abs(value); a > max {
+						max = a
+					}
+				}
+				scale := max / 127
+				if scale == 0 {
+					scale = 1
+				}
+				values := make([]int8, len(w.X))
+				for i, value := range w.X {
+					values[i] = int8(math.Round(value / scale))
+					e := math.Abs(value - float64(values[i])*scale)
+					if e > quantization.Max {
+						quantization.Max = e
+					}
+					quantization.Mean += e
+				}
+				count += len(w.X)
+				write(scale)
+				write(values)
+			}
+		}
+	}
+	if err != nil {
+		return quantization, err
+	}
+	if count > 0 {
+		quantization.Mean /= float64(count)
+	}
+	if err := writer.Flush(); err != nil {
+		return quantization, err
+	}
+	return quantization, output.Close()
+}
+
+// LoadAutos loads auto encoders from a checkpoint, quantized weights are dequantized
+func LoadAutos(path string) ([]Auto, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(input)
+	read := func(data any) {
+		if err == nil {
+			err = binary.Read(reader, binary.LittleEndian, data)
+		}
+	}
+	// every counted item takes at least a byte of the file, so a count larger than the file is corrupt and is
+	// rejected before anything is allocated for it
+	bound := func(name string, n uint64) {
+		if err == nil && n > uint64(info.Size()) {
+			err = fmt.Errorf("%s: %s %d is larger than the file", path, name, n)
+		}
+	}
+
+	magic := make([]byte, len(CheckpointMagic))
+	read(magic)
+	if err == nil && string(magic) != CheckpointMagic {
+		return nil, fmt.Errorf("%s is not a checkpoint", path)
+	}
+	var format, count uint32
+	read(&format)
+	read(&count)
+	bound("count", uint64(count))
+	if err == nil && format != FormatFloat64 && format != FormatInt8 {
+		return nil, fmt.Errorf("%s has an unknown format %d", path, format)
+	}
+	var autos []Auto
+	if err == nil {
+		autos = make([]Auto, 0, count)
+	}
+	for range count {
+		if err != nil {
+			break
+		}
+		var symbol byte
+		var iteration uint64
+		var weights uint32
+		read(&symbol)
+		read(&iteration)
+		read(&weights)
+		a := Auto{
+			Symbol:    symbol,
+			Set:       tf64.NewSet(),
+			Iteration: int(iteration),
+		}
+		for range weights {
+			if err != nil {
+				break
+			}
+			var length, dimensions, size uint32
+			read(&length)
+			bound("name length", uint64(length))
+			if err != nil {
+				break
+			}
+			name := make([]byte, length)
+			read(name)
+			read(&dimensions)
+			bound("dimensions", uint64(dimensions))
+			if err != nil {
+				break
+			}
+			shape := make([]uint32, dimensions)
+			read(shape)
+			read(&size)
+			bound("size", uint64(size))
+			d, product := make([]int, dimensions), uint64(1)
+			for i, s := range shape {
+				d[i] = int(s)
+				product *= uint64(s)
+				bound("shape", product)
+			}
+			if err != nil {
+				break
+			}
+			a.Set.Add(string(name), d...)
+			w := a.Set.ByName[string(name)]
+			w.X = w.X[:0]
+			switch format {
+			case FormatFloat64:
+				values := make([]float64, size)
+				read(values)
+				w.X = append(w.X, values...)
+				var states uint32
+				read(&states)
+				for range states {
+					state := make([]float64, size)
+					read(state)
+					w.States = append(w.States, state)
+				}
+			case FormatInt8:
+				var scale float64
+				values := make([]int8, size)
+				read(&scale)
+				read(values)
+				for _, value := range values {
+					w.X = append(w.X, float64(value)*scale)
+				}
+				w.States = make([][]float64, StateTotal)
+				for i := range w.States {
+					w.States[i] = make([]float64, size)
+				}
+			}
+			if len(w.X) != len(w.D) {
+				return nil, fmt.Errorf("%s: weight %s has %d values for shape %v", path, w.N, len(w.X), w.S)
+			}
+		}
+		autos = append(autos, a)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return autos, nil
+}
+
+// JSONWeight is a weight of an auto encoder in the json format
+type JSONWeight struct {
+	Name   string    `json:"name"`
+	Shape  []int     `json:"shape"`
+	Values []float64 `json:"values"`
+}
+
+// JSONAuto is an auto encoder in the json format
+type JSONAuto struct {
+	Symbol    byte         `json:"symbol"`
+	Iteration int          `json:"iteration"`
+	Weights   []JSONWeight `json:"weights"`
+}
+
+// ExportJSON exports the weights of the auto encoders as a stream of json objects, one per auto encoder,
+// so that only one auto encoder is encoded at a time
+func ExportJSON(path string, autos []Auto) error {
+	output, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	writer := bufio.NewWriter(output)
+	encoder := json.NewEncoder(writer)
+	for _, a := range autos {
+		auto := JSONAuto{
+			Symbol:    a.Symbol,
+			Iteration: a.Iteration,
+		}
+		for _, w := range a.Set.Weights {
+			auto.Weights = append(auto.Weights, JSONWeight{Name: w.N, Shape: w.S, Values: w.X})
+		}
+		if err := encoder.Encode(auto); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return output.Close()
+}
+
+// ImportJSON imports auto encoders exported by ExportJSON, the optimizer states are zero
+func ImportJSON(path string) ([]Auto, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	decoder := json.NewDecoder(bufio.NewReader(input))
+	var autos []Auto
+	for {
+		var auto JSONAuto
+		if err := decoder.Decode(&auto); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		a := Auto{
+			Symbol:    auto.Symbol,
+			Set:       tf64.NewSet(),
+			Iteration: auto.Iteration,
+		}
+		for _, weight := range auto.Weights {
+			a.Set.Add(weight.Name, weight.Shape...)
+			w := a.Set.ByName[weight.Name]
+			if len(weight.Values) != cap(w.X) {
+				return nil, fmt.Errorf("%s: weight %s has %d values for shape %v", path, weight.Name,
+					len(weight.Values), weight.Shape)
+			}
+			w.X = append(w.X[:0], weight.Values...)
+			w.States = make([][]float64, StateTotal)
+			for i := range w.States {
+				w.States[i] = make([]float64, len(w.X))
+			}
+		}
+		autos = append(autos, a)
+	}
+	return autos, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   map[string]string
+		symbols []byte
+	}{
+		{name: "every symbol", flags: map[string]string{"hidden": "8"}, symbols: Symbols()},
+		{name: "vocabulary", flags: map[string]string{"hidden": "8"}, symbols: []byte(SelfTestPattern)},
+		{name: "tied", flags: map[string]string{"hidden": "8", "tied": "true", "activation": "relu"}, symbols: []byte("ab")},
+		{name: "shared", flags: map[string]string{"hidden": "8", "shared": "true"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			rng := rand.New(rand.NewSource(1))
+			autos := NewAutos(test.symbols, rng)
+			data := Synthetic(SelfTestPattern, 64)
+			model := NewModel(data)
+			if err := Train(autos, &model, data, nil, rng); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "autos.json")
+			if err := ExportJSON(path, autos); err != nil {
+				t.Fatal(err)
+			}
+			imported, err := ImportJSON(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(imported) != len(autos) {
+				t.Fatalf("%d auto encoders were imported, %d were exported", len(imported), len(autos))
+			}
+			for i, a := range autos {
+				b := imported[i]
+				if a.Symbol != b.Symbol || a.Iteration != b.Iteration || len(a.Set.Weights) != len(b.Set.Weights) {
+					t.Fatalf("auto encoder %d was imported as symbol %d iteration %d with %d weights, exported as symbol %d iteration %d with %d weights",
+						i, b.Symbol, b.Iteration, len(b.Set.Weights), a.Symbol, a.Iteration, len(a.Set.Weights))
+				}
+				for ii, w := range a.Set.Weights {
+					v := b.Set.Weights[ii]
+					if w.N != v.N || !slices.Equal(w.S, v.S) || !slices.Equal(w.X, v.X) {
+						t.Errorf("weight %s of auto encoder %d differs after the round trip", w.N, i)
+					}
+				}
+			}
+			if want, got := Evaluate(autos, &model, data), Evaluate(imported, &model, data); got != want {
+				t.Errorf("the imported loss is %g, the exported loss is %g", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadAutosCorrupt(t *testing.T) {
+	// header writes a checkpoint with one auto encoder with one weight of the given name length, dimensions, shape,
+	// and size, and no values
+	header := func(count, length, dimensions uint32, shape []uint32, size uint32) []byte {
+		var buffer bytes.Buffer
+		write := func(data any) {
+			if err := binary.Write(&buffer, binary.LittleEndian, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write([]byte(CheckpointMagic))
+		write(uint32(FormatFloat64))
+		write(count)
+		write(byte('a'))
+		write(uint64(0))
+		write(uint32(1))
+		write(length)
+		write([]byte("w"))
+		write(dimensions)
+		write(shape)
+		write(size)
+		return buffer.Bytes()
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "count", data: []byte("AUTO\x00\x00\x00\x00\xff\xff\xff\xff")},
+		{name: "name length", data: header(1, math.MaxUint32, 1, []uint32{1}, 1)},
+		{name: "dimensions", data: header(1, 1, math.MaxUint32, nil, 1)},
+		{name: "shape", data: header(1, 1, 2, []uint32{math.MaxUint32, math.MaxUint32}, 1)},
+		{name: "size", data: header(1, 1, 1, []uint32{1}, math.MaxUint32)},
+		{name: "truncated", data: header(1, 1, 1, []uint32{1}, 1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "autos.bin")
+			if err := os.WriteFile(path, test.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if autos, err := LoadAutos(path); err == nil {
+				t.Errorf("loaded %d auto encoders from a corrupt checkpoint", len(autos))
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// LayerDiff are the statistics of the difference between a layer of two auto encoders
+type LayerDiff struct {
+	Symbol  byte
+	Layer   string
+	MeanAbs float64
+	Max     float64
+	Cosine  float64
+}
+
+// DiffAutos computes the difference between each layer of two sets of auto encoders with the same architecture
+func DiffAutos(a, b []Auto) ([]LayerDiff, error) {
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("%d auto encoders can't be compared with %d", len(a), len(b))
+	}
+	var diffs []LayerDiff
+	for i := range a {
+		if a[i].Symbol != b[i].Symbol {
+			return nil, fmt.Errorf("auto encoder %d is for %s and %s", i, Symbol(a[i].Symbol), Symbol(b[i].Symbol))
+		}
+		if len(a[i].Set.Weights) != len(b[i].Set.Weights) {
+			return nil, fmt.Errorf("auto encoder %s has %d and %d layers", Symbol(a[i].Symbol),
+				len(a[i].Set.Weights), len(b[i].Set.Weights))
+		}
+		for j, x := range a[i].Set.Weights {
+			y := b[i].Set.Weights[j]
+			if x.N != y.N || !slices.Equal(x.S, y.S) {
+				return nil, fmt.Errorf("auto encoder %s has layers %s %v and %s %v", Symbol(a[i].Symbol),
+					x.N, x.S, y.N, y.S)
+			}
+			diff := LayerDiff{
+				Symbol: a[i].Symbol,
+				Layer:  x.N,
+			}
+			dot, xx, yy := 0.0, 0.0, 0.0
+			for k, value := range x.X {
+				d := math.Abs(value - y.X[k])
+				diff.MeanAbs += d
+				diff.Max = math.Max(diff.Max, d)
+				dot += value * y.X[k]
+				xx += value * value
+				yy += y.X[k] * y.X[k]
+			}
+			if len(x.X) > 0 {
+				diff.MeanAbs /= float64(len(x.X))
+			}
+			if xx > 0 && yy > 0 {
+				diff.Cosine = dot / math.Sqrt(xx*yy)
+			} else if xx == yy {
+				diff.Cosine = 1
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/pointlander/gradient/tf64"
+)
+
+// WriteWeightHeatmap writes a 2D weight matrix as a grayscale png, the weights are normalized to 0-255
+// with a column per input and a row per output
+func WriteWeightHeatmap(w *tf64.V, path string) error {
+	if len(w.S) != 2 || w.S[0]*w.S[1] != len(w.X) {
+		return fmt.Errorf("weight %s with shape %v is not a 2D matrix", w.N, w.S)
+	}
+	min, max := math.MaxFloat64, -math.MaxFloat64
+	for _, value := range w.X {
+		min, max = math.Min(min, value), math.Max(max, value)
+	}
+	scale := 0.0
+	if max > min {
+		scale = 255 / (max - min)
+	}
+	width, height := w.S[0], w.S[1]
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.SetGray(x, y, color.Gray{Y: uint8(math.Round((w.X[y*width+x] - min) * scale))})
+		}
+	}
+
+	output, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	if err := png.Encode(output, img); err != nil {
+		return err
+	}
+	return output.Close()
+}
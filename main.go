@@ -5,13 +5,29 @@
 package main
 
 import (
-	"compress/bzip2"
+	"bufio"
+	"bytes"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"math/rand"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/pointlander/gradient/tf64"
 )
@@ -19,12 +35,176 @@ import (
 //go:embed books/*
 var Text embed.FS
 
+var (
+	// FlagConfig is the path of a json config file with the options
+	FlagConfig = flag.String("config", "", "path of a json config file with the options, flags on the command line take precedence")
+	// FlagDropout is the dropout rate of the hidden layer during training
+	FlagDropout = flag.Float64("dropout", 0.0, "dropout rate of the hidden layer during training")
+	// FlagPatience is the number of evaluations without improvement before training stops
+	FlagPatience = flag.Int("patience", 0, "number of evaluations without improvement before training stops, 0 disables")
+	// FlagEvalEvery is how often the validation loss is computed
+	FlagEvalEvery = flag.Int("evalevery", 16*1024, "number of iterations between validation loss evaluations")
+	// FlagValidBytes is the size of the held out validation slice
+	FlagValidBytes = flag.Int("validbytes", 4*1024, "number of bytes held out for validation")
+	// FlagTrainBytes is the number of bytes to train on
+	FlagTrainBytes = flag.Int("trainbytes", 256*1024, "number of bytes of the corpus to train on")
+	// FlagTrainOffset is the offset into the corpus where training starts
+	FlagTrainOffset = flag.Int("trainoffset", 0, "offset into the corpus where training starts")
+	// FlagBaseline generates from a baseline model instead of the auto encoders
+	FlagBaseline = flag.String("baseline", "", "generate from a baseline model instead of the auto encoders: markov")
+	// FlagCache is the directory where decompressed books are cached
+	FlagCache = flag.String("cache", "", "directory where decompressed books are cached")
+	// FlagLoadWorkers is the number of books loaded concurrently
+	FlagLoadWorkers = flag.Int("loadworkers", runtime.NumCPU(), "number of books loaded concurrently")
+	// FlagMix is the weight of the auto encoder distribution mixed with the markov distribution
+	FlagMix = flag.Float64("mix", 1.0, "weight of the auto encoder distribution mixed with the markov distribution")
+	// FlagMetrics prints diversity metrics of the generated output
+	FlagMetrics = flag.Bool("metrics", false, "print diversity metrics of the generated output")
+	// FlagConcat trains on the concatenation of all of the books
+	FlagConcat = flag.Bool("concat", false, "train on the concatenation of all of the books")
+	// FlagSeparator is the byte value that separates the books when concatenated
+	FlagSeparator = flag.Int("separator", 0, "byte value that separates the books when concatenated, it resets the markov context")
+	// FlagResetOn are the bytes that reset the markov context
+	FlagResetOn = flag.String("reseton", "", "bytes that reset the markov context, escapes such as \\n are allowed")
+	// FlagInspect prints the most probable continuations of a context
+	FlagInspect = flag.String("inspect", "", "print the most probable continuations of a context")
+	// FlagTop is the number of continuations to inspect or symbols to report
+	FlagTop = flag.Int("top", 5, "number of continuations to inspect or symbols to report")
+	// FlagPrompt is the prompt to generate from
+	FlagPrompt = flag.String("prompt", "What is the meaning of life?", "prompt to generate from")
+	// FlagPromptFile is a file with the prompt to generate from
+	FlagPromptFile = flag.String("promptfile", "", "file with the prompt to generate from")
+	// FlagSave is the path where the trained auto encoders are saved
+	FlagSave = flag.String("save", "", "path where the trained auto encoders are saved")
+	// FlagLoad is the path of saved auto encoders to generate from instead of training
+	FlagLoad = flag.String("load", "", "path of saved auto encoders to generate from instead of training")
+	// FlagQuantize is the quantized format used when saving: int8
+	FlagQuantize = flag.String("quantize", "", "quantized format used when saving, full precision if empty: int8")
+	// FlagActivation is the activation function of the hidden layer
+	FlagActivation = flag.String("activation", "everett", "activation function of the hidden layer: everett, relu, or tanh")
+	// FlagHidden is the width of the hidden layer
+	FlagHidden = flag.Int("hidden", 256, "width of the hidden layer")
+	// FlagDryRun prints the configuration and an estimated run time without training
+	FlagDryRun = flag.Bool("dryrun", false, "print the configuration and an estimated run time without training")
+	// FlagPerBook prints the perplexity of each book after training
+	FlagPerBook = flag.Bool("perbook", false, "print the perplexity of each book after training")
+	// FlagPerBookBytes is the size of the held out tail of each book
+	FlagPerBookBytes = flag.Int("perbookbytes", 128, "number of bytes at the end of each book used for the per book perplexity")
+	// FlagFreeze are the byte values whose auto encoders are not trained
+	FlagFreeze = flag.String("freeze", "", "byte values whose auto encoders are not trained, such as 0-31,127")
+	// FlagWarmStart initializes the auto encoders near the identity
+	FlagWarmStart = flag.Bool("warmstart", false, "initialize the auto encoders near the identity")
+	// FlagTiming prints the training throughput and step latency
+	FlagTiming = flag.Bool("timing", false, "print the training throughput and step latency")
+	// FlagBooks are the embedded books to load
+	FlagBooks = flag.String("books", "", "comma separated names of the embedded books to load, all if empty, the first is trained on")
+	// FlagSelfTest trains on a synthetic corpus and checks that generation reproduces it
+	FlagSelfTest = flag.Bool("selftest", false, "train on a synthetic corpus and check that generation reproduces it")
+	// FlagVocab creates auto encoders only for the symbols in the training book
+	FlagVocab = flag.Bool("vocab", false, "create auto encoders only for the symbols in the training book")
+	// FlagOutput is the encoding of the generated text
+	FlagOutput = flag.String("output", "utf8", "encoding of the generated text: utf8, hex, base64, or raw")
+	// FlagMixBooks is the weighted mixture of book markov models that generation is conditioned on
+	FlagMixBooks = flag.String("mixbooks", "", "weighted mixture of book markov models that generation is conditioned on, e.g. 2701:0.7,pg74:0.3")
+	// FlagDumpWeights is the path of a heatmap png of the l1 weights of an auto encoder
+	FlagDumpWeights = flag.String("dumpweights", "", "path of a heatmap png of the l1 weights of the auto encoder selected by dumpauto")
+	// FlagDumpAuto is the symbol of the auto encoder whose weights are dumped
+	FlagDumpAuto = flag.Int("dumpauto", 'A', "symbol of the auto encoder whose weights are dumped")
+	// FlagStream builds the markov models of the books after the first from a stream without keeping their data in memory
+	FlagStream = flag.Bool("stream", false, "build the markov models of the books after the first without keeping their data in memory")
+	// FlagLabelSmooth is the weight of the uniform distribution mixed into the reconstruction target
+	FlagLabelSmooth = flag.Float64("labelsmooth", 0, "weight of the uniform distribution mixed into the reconstruction target")
+	// FlagMemStats prints the memory usage after loading the books and after training
+	FlagMemStats = flag.Bool("memstats", false, "print the memory usage after loading the books and after training")
+	// FlagMaxModelMem is the soft cap on the estimated memory of each markov model in megabytes
+	FlagMaxModelMem = flag.Int("maxmodelmem", 0, "soft cap on the estimated memory of each markov model in megabytes, rare high order contexts are pruned to stay under it, 0 disables")
+	// FlagExplain prints the auto encoders with the highest probability at each generation step
+	FlagExplain = flag.Bool("explain", false, "print the top auto encoders by probability at each generation step")
+	// FlagSubsample is the fraction of the training examples that are trained on
+	FlagSubsample = flag.Float64("subsample", 1, "fraction of the training examples that are trained on, chosen at random")
+	// FlagFeatures is the input feature vector of the auto encoders
+	FlagFeatures = flag.String("features", "markov", "input feature vector of the auto encoders: markov or histogram")
+	// FlagProbsOut is the path of a json lines file of the sampling distribution of each generation step
+	FlagProbsOut = flag.String("probsout", "", "path of a json lines file of the sampling distribution and the selected byte of each generation step")
+	// FlagSaveModel is the path where the markov model of the training book is saved
+	FlagSaveModel = flag.String("savemodel", "", "path where the markov model of the training book is saved")
+	// FlagLowercase lowercases the ascii letters of the books and the prompt
+	FlagLowercase = flag.Bool("lowercase", false, "lowercase the ascii letters of the books and the prompt")
+	// FlagEMA is the decay of the exponential moving average of the weights that is used after training
+	FlagEMA = flag.Float64("ema", 0, "decay of the exponential moving average of the weights that is used after training, 0 disables")
+	// FlagMaxTime is the maximum wall clock time of training
+	FlagMaxTime = flag.Duration("maxtime", 0, "maximum wall clock time of training, after which it stops and proceeds with what was learned, 0 disables")
+	// FlagContinueTail primes generation with the tail of the training data instead of a prompt
+	FlagContinueTail = flag.Bool("continuetail", false, "prime generation with the tail of the training data instead of a prompt")
+	// FlagBestOf is the number of generations from the prompt that the most likely is selected from
+	FlagBestOf = flag.Int("bestof", 1, "number of generations from the prompt, the one with the highest markov log likelihood is output")
+	// FlagExportJSON is the path where the trained auto encoders are exported as json
+	FlagExportJSON = flag.String("exportjson", "", "path where the trained auto encoders are exported as json")
+	// FlagImportJSON is the path of auto encoders exported as json to generate from instead of training
+	FlagImportJSON = flag.String("importjson", "", "path of auto encoders exported as json to generate from instead of training")
+	// FlagDenoise is the standard deviation of the gaussian noise added to the input during training
+	FlagDenoise = flag.Float64("denoise", 0, "standard deviation of the gaussian noise added to the input, but not the target, during training")
+	// FlagBalanceLR scales the learning rate of each auto encoder inversely to how often its symbol has been seen
+	FlagBalanceLR = flag.Bool("balancelr", false, "scale the learning rate of each auto encoder inversely to how often its symbol has been seen")
+	// FlagBPB prints the bits per byte of the auto encoders and the markov model over the held out validation slice
+	FlagBPB = flag.Bool("bpb", false, "print the bits per byte of the auto encoders and the markov model over the held out validation slice")
+	// FlagPos appends an encoding of the position in the stream to the input of the auto encoders
+	FlagPos = flag.Bool("pos", false, "append a sinusoidal encoding of the position in the stream to the input of the auto encoders")
+	// FlagInputClip is the range that the inputs of the auto encoders are clamped to
+	FlagInputClip = flag.String("inputclip", "", "range lo,hi that the inputs of the auto encoders are clamped to, disabled if empty")
+	// FlagN is the number of bytes that are generated
+	FlagN = flag.Int("n", 33, "number of bytes that are generated")
+	// FlagPromptsFile is a file with one prompt per line to generate from
+	FlagPromptsFile = flag.String("promptsfile", "", "file with one prompt per line that are each generated from, blank lines are skipped")
+	// FlagOut is the path where the generations from promptsfile are written
+	FlagOut = flag.String("out", "", "path where the generations from promptsfile are written, one quoted prompt and quoted continuation separated by a tab per line, stdout if empty")
+	// FlagShared uses a single auto encoder conditioned on a one hot encoding of the symbol instead of one per symbol
+	FlagShared = flag.Bool("shared", false, "use a single auto encoder whose input includes a one hot encoding of the symbol instead of one auto encoder per symbol")
+	// FlagSampleEvery is the number of training iterations between samples of generated text
+	FlagSampleEvery = flag.Int("sampleevery", 0, "number of training iterations between samples generated with the current weights, 0 disables")
+	// FlagSampleLen is the number of bytes generated for a sample during training
+	FlagSampleLen = flag.Int("samplelen", 33, "number of bytes generated for a sample during training")
+	// FlagSamplePrompt is the prompt of the samples during training
+	FlagSamplePrompt = flag.String("sampleprompt", "", "prompt of the samples generated during training, the prompt flag if empty")
+	// FlagPrune drops the auto encoders that were never trained before generating
+	FlagPrune = flag.Bool("prune", false, "drop the auto encoders that were never trained before generating, their symbols get a fixed low probability")
+	// FlagConfWeight scales the learning rate of each training example by the count of its markov context
+	FlagConfWeight = flag.Bool("confweight", false, "scale the learning rate of each training example by how many times its markov context was observed")
+	// FlagExportONNX is the path where the shared auto encoder is exported as onnx
+	FlagExportONNX = flag.String("exportonnx", "", "path where the trained shared auto encoder is exported as onnx")
+	// FlagEta is the learning rate
+	FlagEta = flag.Float64("eta", Eta, "learning rate of adam")
+	// FlagGrid is a hyperparameter grid that is searched instead of training once
+	FlagGrid = flag.String("grid", "", "hyperparameter grid to search, semicolon separated flags with comma separated values, e.g. eta=1e-2,1e-3;hidden=128,256")
+	// FlagGridBytes is the number of bytes that each configuration of the grid is trained on
+	FlagGridBytes = flag.Int("gridbytes", 16*1024, "number of bytes that each configuration of the grid is trained on")
+	// FlagGridMetric is the validation metric that the configurations of the grid are compared by
+	FlagGridMetric = flag.String("gridmetric", "perplexity", "validation metric that the configurations of the grid are compared by: perplexity or loss")
+	// FlagCoverage prints the kl divergence of the generated byte distribution from the training byte distribution
+	FlagCoverage = flag.Bool("coverage", false, "print the kl divergence of the generated byte distribution from the byte distribution of the training data")
+	// FlagStats prints the statistics of the markov model of each book and exits
+	FlagStats = flag.Bool("stats", false, "print the statistics of the markov model of each book and exit without training or generating")
+	// FlagTied ties the decoder weights of the auto encoders to the transpose of the encoder weights
+	FlagTied = flag.Bool("tied", false, "use the transpose of the l1 weights for l2 instead of independent weights")
+	// FlagChunked is the size of a window of training examples that are grouped by symbol before they are trained on
+	FlagChunked = flag.Int("chunked", 0, "size of a window of training examples that are grouped by symbol so that each auto encoder is trained on its examples contiguously, 0 disables")
+	// FlagFromBaseline initializes the auto encoders to reproduce the markov features exactly, the auto encoder
+	// distribution is uniform until training separates them, so it is meant to be used with mix below 1
+	FlagFromBaseline = flag.Bool("frombaseline", false, "initialize the auto encoders to the exact identity so that they start from the markov baseline")
+	// FlagFlushEvery streams the generated bytes to stdout and flushes after every N of them
+	FlagFlushEvery = flag.Int("flushevery", 0, "stream the generated bytes to stdout and flush after every N of them, 1 disables buffering, 0 writes the generation at the end")
+	// FlagTrace is the path of a json lines file of a trace of each generation step
+	FlagTrace = flag.String("trace", "", "path of a json lines file of the markov context, the lookup entropy, the loss of the selected auto encoder, the top of the sampling distribution, and the selected byte of each generation step")
+	// FlagOrderAblation prints the validation metrics with the lookups restricted to each single order
+	FlagOrderAblation = flag.Bool("orderablation", false, "print the perplexity and loss over the held out validation slice with the markov lookups restricted to each single order, along with full backoff")
+)
+
 const (
 	// B1 exponential decay of the rate for the first moment estimates
 	B1 = 0.8
 	// B2 exponential decay rate for the second-moment estimates
 	B2 = 0.89
-	// Eta is the learning rate
+	// Eta is the default learning rate
 	Eta = 1.0e-3
 )
 
@@ -37,6 +217,9 @@ const (
 	StateTotal
 )
 
+// StateEMA is the optional state with the exponential moving average of the weights, it follows the optimizer states
+const StateEMA = StateTotal
+
 // Histogram is a buffered histogram
 type Histogram struct {
 	Vector [256]byte
@@ -64,285 +247,2867 @@ func (h *Histogram) Add(s byte) {
 	h.Index = index
 }
 
+// HistogramSize is the number of recent symbols in the histogram of a context
+const HistogramSize = 33
+
+// Context is the markov context and the histogram of the recent symbols that the input features are computed from
+type Context struct {
+	Markov    [order]Markov
+	Histogram Histogram
+	Position  int
+	// Lookup looks the distribution of the markov model up for the context, Condition is used if it is nil
+	Lookup func(markov *[order]Markov, model *Model) []float32
+}
+
+// NewContext creates an empty context
+func NewContext() Context {
+	return Context{
+		Histogram: NewHistogram(HistogramSize),
+	}
+}
+
+// Reset empties the context, the lookup is kept
+func (c *Context) Reset() {
+	lookup := c.Lookup
+	*c = NewContext()
+	c.Lookup = lookup
+}
+
+// Condition looks the distribution of the markov model up for the context with the lookup of the context
+func (c *Context) Condition(model *Model) []float32 {
+	if c.Lookup != nil {
+		return c.Lookup(&c.Markov, model)
+	}
+	return Condition(&c.Markov, model)
+}
+
+// Observe advances the context with a symbol
+func (c *Context) Observe(b byte) {
+	Iterate(&c.Markov, b)
+	c.Histogram.Add(b)
+	c.Position++
+}
+
+// Features computes the input feature vector selected by the features flag: the distribution of the markov model
+// for the context or the normalized histogram of the recent symbols, which is uniform if there are none. The
+// encoding of the position is appended if enabled.
+func (c *Context) Features(model *Model) []float64 {
+	var features []float64
+	if *FlagFeatures == "histogram" {
+		sum := 0
+		for _, v := range c.Histogram.Vector {
+			sum += int(v)
+		}
+		features = make([]float64, len(c.Histogram.Vector))
+		for i, v := range c.Histogram.Vector {
+			if sum == 0 {
+				features[i] = 1.0 / float64(len(features))
+				continue
+			}
+			features[i] = float64(v) / float64(sum)
+		}
+	} else {
+		vector := c.Condition(model)
+		features = make([]float64, len(vector))
+		for i, v := range vector {
+			features[i] = float64(v)
+		}
+	}
+	if *FlagPos {
+		features = append(features, Position(c.Position)...)
+	}
+	return features
+}
+
+// PositionWidth is the width of the encoding of a position
+const PositionWidth = 8
+
+// Position encodes a position as sines and cosines of geometrically increasing wavelengths
+func Position(position int) []float64 {
+	features := make([]float64, PositionWidth)
+	for i := 0; i < PositionWidth; i += 2 {
+		angle := float64(position) / math.Pow(10000, float64(i)/PositionWidth)
+		features[i], features[i+1] = math.Sin(angle), math.Cos(angle)
+	}
+	return features
+}
+
+// InputWidth is the width of the input of the auto encoders
+func InputWidth() int {
+	width := 256
+	if *FlagPos {
+		width += PositionWidth
+	}
+	if *FlagShared {
+		width += 256
+	}
+	return width
+}
+
+// OneHot appends a one hot encoding of the symbol to the features for the shared auto encoder, the features are
+// unchanged otherwise
+func OneHot(features []float64, symbol byte) []float64 {
+	if !*FlagShared {
+		return features
+	}
+	encoded := make([]float64, len(features)+256)
+	copy(encoded, features)
+	encoded[len(features)+int(symbol)] = 1
+	return encoded
+}
+
+// ByteCounts counts the occurrences of each byte in data
+func ByteCounts(data []byte) [256]int {
+	var counts [256]int
+	for _, value := range data {
+		counts[value]++
+	}
+	return counts
+}
+
+// ByteKL is the kl divergence KL(generated || corpus) in bits between the byte distributions of generated and corpus,
+// both distributions are add one smoothed so that bytes missing from either don't make it infinite
+func ByteKL(generated, corpus []byte) float64 {
+	p, q := ByteCounts(generated), ByteCounts(corpus)
+	kl := 0.0
+	for i := range p {
+		pi := float64(p[i]+1) / float64(len(generated)+256)
+		qi := float64(q[i]+1) / float64(len(corpus)+256)
+		kl += pi * math.Log2(pi/qi)
+	}
+	return kl
+}
+
+// Stats are diversity statistics of generated output
+type Stats struct {
+	Entropy      float64
+	Distinct     int
+	MostFrequent byte
+}
+
+// OutputStats computes the shannon entropy in bits, the number of distinct bytes, and the most frequent byte of the output
+func OutputStats(generated []byte) Stats {
+	stats := Stats{}
+	if len(generated) == 0 {
+		return stats
+	}
+	counts := ByteCounts(generated)
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		stats.Distinct++
+		if count > counts[stats.MostFrequent] {
+			stats.MostFrequent = byte(i)
+		}
+		p := float64(count) / float64(len(generated))
+		stats.Entropy -= p * math.Log2(p)
+	}
+	return stats
+}
+
+// String formats the statistics
+func (s Stats) String() string {
+	return fmt.Sprintf("entropy=%f distinct=%d mostfrequent=%q", s.Entropy, s.Distinct, s.MostFrequent)
+}
+
 const (
 	order = 4
 )
 
 type Markov [order]byte
-type Model [order]map[Markov][]uint32
 
-// Lookup looks a vector up
+// Model is a markov model, the counts of the next symbol for each context of each order, and the context at the
+// end of the data that was counted so that more data can be counted as a continuation of the stream
+type Model struct {
+	Counts [order]map[Markov][]uint32
+	Markov [order]Markov
+}
+
+// Lookup looks a vector up, backing off from the highest order so that the highest order with counts for the
+// context wins, the vector is uniform if no order has counts for the context
 func Lookup(markov *[order]Markov, model *Model) []float32 {
-	for i := range markov {
-		i = order - 1 - i
-		vector := model[i][markov[i]]
-		if vector != nil {
-			sum := float32(0.0)
-			for _, value := range vector {
-				sum += float32(value)
-			}
-			result := make([]float32, len(vector))
-			for ii, value := range vector {
-				result[ii] = float32(value) / sum
-			}
-			return result
+	if vector := Backoff(markov, model); vector != nil {
+		return vector
+	}
+	return Uniform()
+}
+
+// Backoff looks a vector up, backing off from the highest order, it is nil if no order has counts for the context
+func Backoff(markov *[order]Markov, model *Model) []float32 {
+	if counts := Counts(markov, model); counts != nil {
+		return Normalize(counts)
+	}
+	return nil
+}
+
+// LookupOrder looks a vector up in the single order level without backing off, the vector is uniform if the order
+// has no counts for the context
+func LookupOrder(markov *[order]Markov, model *Model, level int) []float32 {
+	if counts := model.Counts[level][markov[level]]; counts != nil {
+		return Normalize(counts)
+	}
+	return Uniform()
+}
+
+// Counts is the count vector of the highest order with counts for the context, it is nil if no order has counts
+func Counts(markov *[order]Markov, model *Model) []uint32 {
+	for i := order - 1; i >= 0; i-- {
+		if vector := model.Counts[i][markov[i]]; vector != nil {
+			return vector
 		}
 	}
 	return nil
 }
 
-// Iterate iterates a markov model
-func Iterate(markov *[order]Markov, state byte) {
+// LookupCount is Lookup along with the total count behind the vector, the count is 0 if the vector is uniform
+func LookupCount(markov *[order]Markov, model *Model) ([]float32, uint32) {
+	counts := Counts(markov, model)
+	if counts == nil {
+		return Uniform(), 0
+	}
+	sum := uint32(0)
+	for _, value := range counts {
+		sum += value
+	}
+	return Normalize(counts), sum
+}
+
+// ConfidenceHalf sets how quickly the confidence weight saturates, a context observed ConfidenceHalf-1 times gets one half
+const ConfidenceHalf = 16
+
+// ConfidenceWeight is the learning rate scale of an example whose context was observed count times,
+// (count+1)/(count+1+ConfidenceHalf), which grows with the count and saturates at 1
+func ConfidenceWeight(count uint32) float64 {
+	return float64(count+1) / float64(count+1+ConfidenceHalf)
+}
+
+// Uniform is the uniform distribution over the 256 symbols
+func Uniform() []float32 {
+	vector := make([]float32, 256)
+	for i := range vector {
+		vector[i] = 1.0 / 256
+	}
+	return vector
+}
+
+// Component is the markov model of a book and its weight in a mixture
+type Component struct {
+	Model  *Model
+	Weight float64
+}
+
+// Mixture are the markov models that generation is conditioned on, the model of the training book is used if empty
+var Mixture []Component
+
+// MixLookup looks a vector up in each markov model of the mixture and combines the vectors by weight,
+// the weights are renormalized over the models that have a vector for the context, the vector is uniform if none do
+func MixLookup(markov *[order]Markov, mixture []Component) []float32 {
+	var result []float32
+	total := 0.0
+	for _, component := range mixture {
+		vector := Backoff(markov, component.Model)
+		if vector == nil {
+			continue
+		}
+		if result == nil {
+			result = make([]float32, len(vector))
+		}
+		for i, value := range vector {
+			result[i] += float32(component.Weight) * value
+		}
+		total += component.Weight
+	}
+	if result == nil {
+		return Uniform()
+	}
+	for i := range result {
+		result[i] /= float32(total)
+	}
+	return result
+}
+
+// Condition looks a vector up in the mixture if there is one, otherwise in the model
+func Condition(markov *[order]Markov, model *Model) []float32 {
+	if len(Mixture) > 0 {
+		return MixLookup(markov, Mixture)
+	}
+	return Lookup(markov, model)
+}
+
+// ParseMixture parses a comma separated list of book:weight pairs into a mixture with weights that sum to 1,
+// a book is named by its file name with or without the extensions
+func ParseMixture(spec string, files []File) ([]Component, error) {
+	var mixture []Component
+	total := 0.0
+	for _, pair := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not book:weight", pair)
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%q has an invalid weight", pair)
+		}
+		index := slices.IndexFunc(files, func(file File) bool {
+			base, _, _ := strings.Cut(file.Name, ".")
+			return file.Name == name || base == name
+		})
+		if index < 0 {
+			return nil, fmt.Errorf("book %q isn't loaded", name)
+		}
+		mixture = append(mixture, Component{Model: &files[index].Model, Weight: weight})
+		total += weight
+	}
+	if total <= 0 {
+		return nil, errors.New("the weights must sum to a positive value")
+	}
+	for i := range mixture {
+		mixture[i].Weight /= total
+	}
+	return mixture, nil
+}
+
+// Normalize converts counts into a probability distribution
+func Normalize(vector []uint32) []float32 {
+	sum := float32(0.0)
+	for _, value := range vector {
+		sum += float32(value)
+	}
+	result := make([]float32, len(vector))
+	for i, value := range vector {
+		result[i] = float32(value) / sum
+	}
+	return result
+}
+
+// Next is a possible next symbol and its probability
+type Next struct {
+	Byte byte    `json:"byte"`
+	Prob float32 `json:"probability"`
+}
+
+// Top returns the n most probable symbols of a distribution
+func Top(vector []float32, n int) []Next {
+	next := make([]Next, 0, len(vector))
+	for i, value := range vector {
+		if value > 0 {
+			next = append(next, Next{Byte: byte(i), Prob: value})
+		}
+	}
+	sort.SliceStable(next, func(i, j int) bool {
+		return next[i].Prob > next[j].Prob
+	})
+	if len(next) > n {
+		next = next[:n]
+	}
+	return next
+}
+
+// TopNext returns the n most probable next symbols for the markov context
+func TopNext(markov *[order]Markov, model *Model, n int) []Next {
+	return Top(Lookup(markov, model), n)
+}
+
+// Symbol formats a symbol for display
+func Symbol(symbol byte) string {
+	if symbol < utf8.RuneSelf && strconv.IsPrint(rune(symbol)) {
+		return strconv.QuoteRune(rune(symbol))
+	}
+	return fmt.Sprintf("0x%02x", symbol)
+}
+
+// Inspect prints the most probable next symbols for a context at each order and for the backoff
+func Inspect(context []byte, model *Model, n int) {
+	markov := [order]Markov{}
+	for _, value := range context {
+		Iterate(&markov, value)
+	}
+	show := func(name string, next []Next) {
+		fmt.Fprintf(Stdout, "%-8s", name)
+		for _, value := range next {
+			fmt.Fprintf(Stdout, " %s:%.4f", Symbol(value.Byte), value.Prob)
+		}
+		fmt.Fprintln(Stdout)
+	}
 	for i := range markov {
-		state := state
-		for ii, value := range markov[i][:i+1] {
-			markov[i][ii], state = state, value
+		vector := model.Counts[i][markov[i]]
+		if vector == nil {
+			show(fmt.Sprintf("order %d", i), nil)
+			continue
 		}
+		show(fmt.Sprintf("order %d", i), Top(Normalize(vector), n))
 	}
+	show("backoff", TopNext(&markov, model, n))
 }
 
-func main() {
-	type File struct {
-		Name  string
-		Data  []byte
-		Model Model
-	}
-
-	files := []File{
-		{Name: "10.txt.utf-8.bz2"},
-		{Name: "pg74.txt.bz2"},
-		{Name: "76.txt.utf-8.bz2"},
-		{Name: "84.txt.utf-8.bz2"},
-		{Name: "100.txt.utf-8.bz2"},
-		{Name: "1837.txt.utf-8.bz2"},
-		{Name: "2701.txt.utf-8.bz2"},
-		{Name: "3176.txt.utf-8.bz2"},
-	}
-
-	load := func(book *File) {
-		path := fmt.Sprintf("books/%s", book.Name)
-		file, err := Text.Open(path)
+// SampleMarkov samples the next symbol from the markov model
+func SampleMarkov(markov *[order]Markov, model *Model, rng *rand.Rand) byte {
+	vector := Condition(markov, model)
+	total, selected := float32(0.0), rng.Float32()
+	for i, value := range vector {
+		total += value
+		if selected < total {
+			return byte(i)
+		}
+	}
+	return byte(len(vector) - 1)
+}
+
+// Resets are the symbols that reset the markov context
+var Resets [256]bool
+
+// Frozen are the symbols whose auto encoders are not trained
+var Frozen map[byte]bool
+
+// Transform is applied to every byte of the books and the prompt when they are ingested, nil leaves them unchanged
+var Transform func(b byte) byte
+
+// Lowercase lowercases an ascii letter
+func Lowercase(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// Ingest applies Transform to data in place and returns it
+func Ingest(data []byte) []byte {
+	if Transform == nil {
+		return data
+	}
+	for i, value := range data {
+		data[i] = Transform(value)
+	}
+	return data
+}
+
+// IngestReader applies Transform to the bytes read from a stream
+type IngestReader struct {
+	Reader io.Reader
+}
+
+// Read reads from the stream and ingests the bytes that were read
+func (i IngestReader) Read(p []byte) (int, error) {
+	n, err := i.Reader.Read(p)
+	Ingest(p[:n])
+	return n, err
+}
+
+// ParseRanges parses a comma separated list of byte values and inclusive ranges such as 0-31,127
+func ParseRanges(spec string) (map[byte]bool, error) {
+	symbols := make(map[byte]bool)
+	if spec == "" {
+		return symbols, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		low, high, found := strings.Cut(strings.TrimSpace(part), "-")
+		if !found {
+			high = low
+		}
+		a, err := strconv.ParseUint(strings.TrimSpace(low), 10, 8)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("invalid range %q: %w", part, err)
 		}
-		defer file.Close()
-		breader := bzip2.NewReader(file)
-		data, err := io.ReadAll(breader)
+		b, err := strconv.ParseUint(strings.TrimSpace(high), 10, 8)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("invalid range %q: %w", part, err)
 		}
-
-		markov := [order]Markov{}
-		for i := range book.Model {
-			book.Model[i] = make(map[Markov][]uint32)
+		if a > b {
+			return nil, fmt.Errorf("invalid range %q: %d is greater than %d", part, a, b)
 		}
-		for _, value := range data {
-			for ii := range markov {
-				vector := book.Model[ii][markov[ii]]
-				if vector == nil {
-					vector = make([]uint32, 256)
-				}
-				vector[value]++
-				book.Model[ii][markov[ii]] = vector
+		for i := a; i <= b; i++ {
+			symbols[byte(i)] = true
+		}
+	}
+	return symbols, nil
+}
 
-				state := value
-				for iii, value := range markov[ii][:ii+1] {
-					markov[ii][iii], state = state, value
-				}
-			}
+// NewModel builds a markov model from data
+func NewModel(data []byte) Model {
+	model, _ := NewModelReader(bytes.NewReader(data))
+	return model
+}
+
+// NewModelReader builds a markov model from a stream of bytes without holding the stream in memory
+func NewModelReader(input io.Reader) (Model, error) {
+	var model Model
+	model.init()
+	reader := bufio.NewReader(input)
+	budget := *FlagMaxModelMem * 1024 * 1024
+	for count := 1; ; count++ {
+		value, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return model, err
+		}
+		model.Add(&model.Markov, value)
+		Iterate(&model.Markov, value)
+		if budget > 0 && count%PruneEvery == 0 {
+			model.Fit(budget)
 		}
-		book.Data = data
 	}
+	if budget > 0 {
+		model.Fit(budget)
+	}
+	return model, nil
+}
 
-	for i := range files {
-		load(&files[i])
-		fmt.Println(files[i].Name)
+// init makes the count maps of the orders that don't have one
+func (m *Model) init() {
+	for i := range m.Counts {
+		if m.Counts[i] == nil {
+			m.Counts[i] = make(map[Markov][]uint32)
+		}
 	}
+}
 
-	type Auto struct {
-		Set       tf64.Set
-		Iteration int
+// Ingest counts data as a continuation of the data that was already counted, so that counting data in parts builds
+// the same markov model as counting it all at once
+func (m *Model) Ingest(data []byte) {
+	m.init()
+	for _, value := range data {
+		m.Add(&m.Markov, value)
+		Iterate(&m.Markov, value)
+	}
+	if budget := *FlagMaxModelMem * 1024 * 1024; budget > 0 {
+		m.Fit(budget)
 	}
+}
 
-	rng := rand.New(rand.NewSource(1))
+// ContextSize is the estimated memory of a context of a markov model: the count vector and the map entry
+const ContextSize = 256*4 + 64
 
-	autos := make([]Auto, 256)
-	for i := range autos {
-		autos[i].Set = tf64.NewSet()
-		autos[i].Set.Add("l1", 256, 256)
-		autos[i].Set.Add("b1", 256, 1)
-		autos[i].Set.Add("l2", 512, 256)
-		autos[i].Set.Add("b2", 256, 1)
-
-		for ii := range autos[i].Set.Weights {
-			w := autos[i].Set.Weights[ii]
-			if strings.HasPrefix(w.N, "b") {
-				w.X = w.X[:cap(w.X)]
-				w.States = make([][]float64, StateTotal)
-				for ii := range w.States {
-					w.States[ii] = make([]float64, len(w.X))
-				}
-				continue
-			}
-			factor := math.Sqrt(2.0 / float64(w.S[0]))
-			for range cap(w.X) {
-				w.X = append(w.X, rng.NormFloat64()*factor)
+// PruneEvery is the number of bytes between checks of the memory of a markov model that is being built
+const PruneEvery = 64 * 1024
+
+// Size is the estimated memory of the markov model
+func (m *Model) Size() int {
+	contexts := 0
+	for i := range m.Counts {
+		contexts += len(m.Counts[i])
+	}
+	return contexts * ContextSize
+}
+
+// Prune removes the contexts above the lowest order whose total count is below threshold and returns the number
+// of contexts above the lowest order that remain
+func (m *Model) Prune(threshold uint32) int {
+	remaining := 0
+	for i := 1; i < order; i++ {
+		for context, vector := range m.Counts[i] {
+			sum := uint32(0)
+			for _, value := range vector {
+				sum += value
 			}
-			w.States = make([][]float64, StateTotal)
-			for ii := range w.States {
-				w.States[ii] = make([]float64, len(w.X))
+			if sum < threshold {
+				delete(m.Counts[i], context)
+				continue
 			}
+			remaining++
 		}
 	}
+	return remaining
+}
 
-	//histogram := NewHistogram(33)
-	markov := [order]Markov{}
-	iteration := 0
+// Fit prunes rare contexts with a doubling threshold until the estimated memory of the markov model is within budget,
+// the lowest order is never pruned so that backoff still works
+func (m *Model) Fit(budget int) {
+	for threshold := uint32(2); m.Size() > budget; threshold *= 2 {
+		if m.Prune(threshold) == 0 {
+			return
+		}
+	}
+}
 
-	//histogram.Add(0)
-	Iterate(&markov, 0)
-	for _, value := range files[0].Data[:256*1024] {
-		pow := func(x float64) float64 {
-			y := math.Pow(x, float64(autos[value].Iteration+1))
-			if math.IsNaN(y) || math.IsInf(y, 0) {
-				return 0
-			}
-			return y
+// Add counts value in each order of the markov model for the context
+func (m *Model) Add(markov *[order]Markov, value byte) {
+	for i := range markov {
+		vector := m.Counts[i][markov[i]]
+		if vector == nil {
+			vector = make([]uint32, 256)
 		}
+		vector[value]++
+		m.Counts[i][markov[i]] = vector
+	}
+}
 
-		others := tf64.NewSet()
-		others.Add("input", 256, 1)
-		others.Add("output", 256, 1)
-		in := others.ByName["input"]
-		out := others.ByName["output"]
-		/*sum := 0
-		for _, v := range histogram.Vector {
-			sum += int(v)
+// Iterate iterates a markov model, the context is reset after a symbol in Resets
+func Iterate(markov *[order]Markov, state byte) {
+	if Resets[state] {
+		*markov = [order]Markov{}
+		return
+	}
+	for i := range markov {
+		state := state
+		for ii, value := range markov[i][:i+1] {
+			markov[i][ii], state = state, value
 		}
-		for _, v := range histogram.Vector {
-			vv := float64(v) / float64(sum)
-			in.X = append(in.X, vv)
-			out.X = append(out.X, vv)
-		}*/
-		vector := Lookup(&markov, &files[0].Model)
-		for _, v := range vector {
-			in.X = append(in.X, float64(v))
-			out.X = append(out.X, float64(v))
+	}
+}
+
+// Auto is an auto encoder for the symbol that follows a context
+type Auto struct {
+	Symbol    byte
+	Set       tf64.Set
+	Iteration int
+	// Rate scales the learning rate, 0 is the same as 1
+	Rate float64
+}
+
+// BalanceLimit bounds the scale of a balanced learning rate to [1/BalanceLimit, BalanceLimit]
+const BalanceLimit = 10.0
+
+// BalancedRate is the learning rate scale of an auto encoder that has been updated observed times out of total
+// updates of autos auto encoders: sqrt((total/autos)/observed), so that an auto encoder seen less often than the
+// average gets a larger learning rate and one seen more often gets a smaller one
+func BalancedRate(observed, total, autos int) float64 {
+	rate := math.Sqrt(float64(total) / float64(autos) / float64(max(observed, 1)))
+	return min(max(rate, 1/BalanceLimit), BalanceLimit)
+}
+
+// Vocabulary is the sorted set of symbols that occur in data
+func Vocabulary(data []byte) []byte {
+	var seen [256]bool
+	for _, value := range data {
+		seen[value] = true
+	}
+	var symbols []byte
+	for i, ok := range seen {
+		if ok {
+			symbols = append(symbols, byte(i))
 		}
+	}
+	return symbols
+}
 
-		l1 := tf64.Everett(tf64.Add(tf64.Mul(autos[value].Set.Get("l1"), others.Get("input")), autos[value].Set.Get("b1")))
-		l2 := tf64.Add(tf64.Mul(autos[value].Set.Get("l2"), l1), autos[value].Set.Get("b2"))
-		loss := tf64.Sum(tf64.Quadratic(l2, others.Get("output")))
+// Symbols is the set of all 256 symbols
+func Symbols() []byte {
+	symbols := make([]byte, 256)
+	for i := range symbols {
+		symbols[i] = byte(i)
+	}
+	return symbols
+}
 
-		l := 0.0
-		autos[value].Set.Zero()
-		others.Zero()
-		l = tf64.Gradient(loss).X[0]
-		if math.IsNaN(float64(l)) || math.IsInf(float64(l), 0) {
-			fmt.Println(iteration, l)
-			return
+// Indexes maps each symbol to the index of its auto encoder, or -1 if the symbol has no auto encoder,
+// every symbol maps to the shared auto encoder
+func Indexes(autos []Auto) [256]int {
+	var indexes [256]int
+	for i := range indexes {
+		indexes[i] = -1
+		if *FlagShared && len(autos) > 0 {
+			indexes[i] = 0
 		}
+	}
+	if *FlagShared {
+		return indexes
+	}
+	for i, a := range autos {
+		indexes[a.Symbol] = i
+	}
+	return indexes
+}
 
-		norm := 0.0
-		for _, p := range autos[value].Set.Weights {
-			for _, d := range p.D {
-				norm += d * d
-			}
+// Activation is an activation function of the hidden layer
+type Activation struct {
+	F func(a tf64.Meta, options ...map[string]interface{}) tf64.Meta
+}
+
+// Activations are the activation functions of the hidden layer by name
+var Activations = map[string]Activation{
+	"everett": {F: tf64.Everett},
+	"relu":    {F: tf64.ReLu},
+	"tanh":    {F: tf64.TanH},
+}
+
+// Width is the output width of the activation for an input width, it is found by applying the activation to a
+// zero input so that the layers can't get out of sync with the activation
+func (a Activation) Width(width int) int {
+	set := tf64.NewSet()
+	set.Add("x", width, 1)
+	x := set.ByName["x"]
+	x.X = x.X[:cap(x.X)]
+	output := 0
+	a.F(set.Get("x"))(func(v *tf64.V) bool {
+		output = v.S[0]
+		return true
+	})
+	return output
+}
+
+// WarmStartNoise is the scale of the random weights relative to the identity for a warm start
+const WarmStartNoise = 0.01
+
+// NewAutos creates a randomly initialized auto encoder for each symbol, or a single shared auto encoder
+func NewAutos(symbols []byte, rng *rand.Rand) []Auto {
+	if *FlagShared {
+		return []Auto{NewAuto(rng)}
+	}
+	autos := make([]Auto, len(symbols))
+	for i, symbol := range symbols {
+		autos[i] = NewAuto(rng)
+		autos[i].Symbol = symbol
+	}
+	return autos
+}
+
+// Identity adds an identity mapping to the weights of the auto encoder after scaling the existing weights by noise,
+// so that the forward pass approximately reproduces the input. The everett activation splits each hidden unit into
+// its negative and positive parts, so both halves map back to the output.
+func (a *Auto) Identity(noise float64) {
+	for _, w := range a.Set.Weights {
+		for i := range w.X {
+			w.X[i] *= noise
 		}
-		norm = math.Sqrt(norm)
-		b1, b2 := pow(B1), pow(B2)
-		scaling := 1.0
-		if norm > 1 {
-			scaling = 1 / norm
-		}
-		for _, w := range autos[value].Set.Weights {
-			for ii, d := range w.D {
-				g := d * scaling
-				m := B1*w.States[StateM][ii] + (1-B1)*g
-				v := B2*w.States[StateV][ii] + (1-B2)*g*g
-				w.States[StateM][ii] = m
-				w.States[StateV][ii] = v
-				mhat := m / (1 - b1)
-				vhat := v / (1 - b2)
-				if vhat < 0 {
-					vhat = 0
-				}
-				w.X[ii] -= Eta * mhat / (math.Sqrt(vhat) + 1e-8)
-			}
+	}
+	l1, l2 := a.Set.ByName["l1"], a.Set.ByName["l2"]
+	if l2 == nil {
+		// the tied decoder is the transpose of l1, so it is the identity along with l1
+		for i := range min(l1.S[0], l1.S[1]) {
+			l1.X[i*l1.S[0]+i] += 1
 		}
-		iteration++
-		autos[value].Iteration++
-		if iteration%1024 == 0 || iteration < 1024 {
-			fmt.Println(iteration, l)
+		return
+	}
+	doubles := l2.S[0] == 2*l1.S[1]
+	for i := range min(l1.S[0], l1.S[1], l2.S[1]) {
+		l1.X[i*l1.S[0]+i] += 1
+		if doubles {
+			l2.X[i*l2.S[0]+2*i] += 1
+			l2.X[i*l2.S[0]+2*i+1] += 1
+			continue
 		}
+		l2.X[i*l2.S[0]+i] += 1
+	}
+}
 
-		//histogram.Add(value)
-		Iterate(&markov, value)
+// Loss builds the reconstruction loss graph of the auto encoder, dropout is only applied when training
+func (a *Auto) Loss(others *tf64.Set, training bool, rng *rand.Rand) tf64.Meta {
+	l1 := Activations[*FlagActivation].F(tf64.Add(tf64.Mul(a.Set.Get("l1"), others.Get("input")), a.Set.Get("b1")))
+	if training && *FlagDropout > 0 {
+		drop := *FlagDropout
+		l1 = tf64.Dropout(l1, map[string]interface{}{"rng": rng, "drop": &drop})
 	}
+	l2 := tf64.Add(tf64.Mul(a.Decoder(), l1), a.Set.Get("b2"))
+	return tf64.Sum(tf64.Quadratic(l2, others.Get("output")))
+}
 
-	prompt := "What is the meaning of life?"
-	str := []byte(prompt)
-	//histogram = NewHistogram(33)
-	markov = [order]Markov{}
-	for _, value := range str {
-		//histogram.Add(value)
-		Iterate(&markov, value)
+// Decoder is the l2 weights of the auto encoder, or the transpose of the l1 weights if they are tied, the gradients
+// of both uses of tied weights accumulate in l1
+func (a *Auto) Decoder() tf64.Meta {
+	if a.Set.ByName["l2"] == nil {
+		return tf64.T(a.Set.Get("l1"))
 	}
-	for range 33 {
-		distribution := make([]float64, len(autos))
-		for i := range autos {
-			others := tf64.NewSet()
-			others.Add("input", 256, 1)
-			others.Add("output", 256, 1)
-			in := others.ByName["input"]
-			out := others.ByName["output"]
-			/*sum := 0
-			for _, v := range histogram.Vector {
-				sum += int(v)
-			}
-			for _, v := range histogram.Vector {
-				vv := float64(v) / float64(sum)
-				in.X = append(in.X, vv)
-				out.X = append(out.X, vv)
-			}*/
-			vector := Lookup(&markov, &files[0].Model)
-			for _, v := range vector {
-				in.X = append(in.X, float64(v))
-				out.X = append(out.X, float64(v))
-			}
-			l1 := tf64.Everett(tf64.Add(tf64.Mul(autos[i].Set.Get("l1"), others.Get("input")), autos[i].Set.Get("b1")))
-			l2 := tf64.Add(tf64.Mul(autos[i].Set.Get("l2"), l1), autos[i].Set.Get("b2"))
-			loss := tf64.Sum(tf64.Quadratic(l2, others.Get("output")))
-
-			autos[i].Set.Zero()
-			others.Zero()
-			loss(func(a *tf64.V) bool {
-				distribution[i] = a.X[0]
-				return true
-			})
-		}
-		max := 0.0
-		for _, value := range distribution {
-			if value > max {
-				max = value
-			}
+	return a.Set.Get("l2")
+}
+
+// Update does a forward pass, a backward pass, and an adam update of the auto encoder and returns the loss,
+// the weights are not updated if the loss isn't finite. The input is corrupted with noise for a denoising auto encoder.
+func (a *Auto) Update(others *tf64.Set, rng *rand.Rand) float64 {
+	pow := func(x float64) float64 {
+		y := math.Pow(x, float64(a.Iteration+1))
+		if math.IsNaN(y) || math.IsInf(y, 0) {
+			return 0
 		}
-		sum := 0.0
-		for i, value := range distribution {
-			value = max - value
-			sum += value
-			distribution[i] = value
+		return y
+	}
+
+	if *FlagDenoise > 0 {
+		in := others.ByName["input"]
+		// only the markov features are corrupted, the position and the one hot symbol are what the auto encoder
+		// is conditioned on
+		for i := range in.X[:256] {
+			in.X[i] += rng.NormFloat64() * *FlagDenoise
 		}
-		total, selected := 0.0, rng.Float64()
-		for i, value := range distribution {
-			total += value / sum
-			if selected < total {
-				str = append(str, byte(i))
-				//histogram.Add(byte(i))
-				Iterate(&markov, byte(i))
-				break
+		// the noise can leave the range that the inputs are clamped to
+		if InputClip != nil {
+			Clamp(in.X, InputClip[0], InputClip[1])
+		}
+	}
+
+	loss := a.Loss(others, true, rng)
+
+	l := 0.0
+	a.Set.Zero()
+	others.Zero()
+	l = tf64.Gradient(loss).X[0]
+	if math.IsNaN(float64(l)) || math.IsInf(float64(l), 0) {
+		return l
+	}
+
+	norm := 0.0
+	for _, p := range a.Set.Weights {
+		for _, d := range p.D {
+			norm += d * d
+		}
+	}
+	norm = math.Sqrt(norm)
+	b1, b2 := pow(B1), pow(B2)
+	eta := *FlagEta
+	if a.Rate > 0 {
+		eta *= a.Rate
+	}
+	scaling := 1.0
+	if norm > 1 {
+		scaling = 1 / norm
+	}
+	for _, w := range a.Set.Weights {
+		for ii, d := range w.D {
+			g := d * scaling
+			m := B1*w.States[StateM][ii] + (1-B1)*g
+			v := B2*w.States[StateV][ii] + (1-B2)*g*g
+			w.States[StateM][ii] = m
+			w.States[StateV][ii] = v
+			mhat := m / (1 - b1)
+			vhat := v / (1 - b2)
+			if vhat < 0 {
+				vhat = 0
+			}
+			w.X[ii] -= eta * mhat / (math.Sqrt(vhat) + 1e-8)
+		}
+		if len(w.States) > StateEMA {
+			decay := *FlagEMA
+			for ii, value := range w.X {
+				w.States[StateEMA][ii] = decay*w.States[StateEMA][ii] + (1-decay)*value
+			}
+		}
+	}
+	a.Iteration++
+	return l
+}
+
+// EnableEMA adds the exponential moving average state to the weights, starting from the current weights
+func (a *Auto) EnableEMA() {
+	for _, w := range a.Set.Weights {
+		if len(w.States) > StateEMA {
+			continue
+		}
+		w.States = append(w.States, append([]float64{}, w.X...))
+	}
+}
+
+// SwapEMA swaps the weights with their exponential moving average if it is enabled
+func (a *Auto) SwapEMA() {
+	for _, w := range a.Set.Weights {
+		if len(w.States) > StateEMA {
+			w.X, w.States[StateEMA] = w.States[StateEMA], w.X
+		}
+	}
+}
+
+// Evaluate computes the average reconstruction loss of the auto encoders over data, symbols without an auto encoder are skipped
+func Evaluate(autos []Auto, model *Model, data []byte) float64 {
+	context := NewContext()
+	return EvaluateContext(autos, model, &context, data)
+}
+
+// EvaluateContext is Evaluate starting from a context, the context is advanced through data
+func EvaluateContext(autos []Auto, model *Model, context *Context, data []byte) float64 {
+	indexes := Indexes(autos)
+	total, count := 0.0, 0
+	for _, value := range data {
+		index := indexes[value]
+		if index < 0 {
+			context.Observe(value)
+			continue
+		}
+		others := Inputs(OneHot(context.Features(model), value))
+		loss := autos[index].Loss(&others, false, nil)
+		loss(func(a *tf64.V) bool {
+			total += a.X[0]
+			return true
+		})
+		count++
+		context.Observe(value)
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+// ConfusionReport computes the average probability predicted for each symbol when it is the next symbol in data
+func ConfusionReport(autos []Auto, model *Model, data []byte) map[byte]float64 {
+	context := NewContext()
+	sums, counts := make(map[byte]float64), make(map[byte]int)
+	for _, value := range data {
+		distribution := Predict(autos, &context, model)
+		sums[value] += distribution[value]
+		counts[value]++
+		context.Observe(value)
+	}
+	for symbol, count := range counts {
+		sums[symbol] /= float64(count)
+	}
+	return sums
+}
+
+// Perplexity computes the perplexity of the predicted distributions over data, the markov context is primed with prefix
+func Perplexity(autos []Auto, model *Model, prefix, data []byte) float64 {
+	context := NewContext()
+	for _, value := range prefix {
+		context.Observe(value)
+	}
+	entropy := 0.0
+	for _, value := range data {
+		p := Predict(autos, &context, model)[value]
+		// a symbol predicted with zero probability would make the perplexity infinite
+		entropy -= math.Log(math.Max(p, 1e-9))
+		context.Observe(value)
+	}
+	if len(data) == 0 {
+		return 0
+	}
+	return math.Exp(entropy / float64(len(data)))
+}
+
+// BitsPerByte is the ideal code length of data in bits per byte, -sum log2 p(next byte) / len(data), where predict
+// computes the distribution of the next byte for the context, the context is advanced through data
+func BitsPerByte(predict func(context *Context) []float64, context *Context, data []byte) float64 {
+	bits := 0.0
+	for _, value := range data {
+		p := predict(context)[value]
+		// a symbol predicted with zero probability would have an infinite code length
+		bits -= math.Log2(math.Max(p, 1e-9))
+		context.Observe(value)
+	}
+	if len(data) == 0 {
+		return 0
+	}
+	return bits / float64(len(data))
+}
+
+// EvaluatePerBook computes the perplexity of each book over its held out tail with its own markov model,
+// books that were streamed don't have data and are skipped
+func EvaluatePerBook(autos []Auto, files []File) map[string]float64 {
+	perplexities := make(map[string]float64, len(files))
+	for i := range files {
+		data := files[i].Data
+		if data == nil {
+			continue
+		}
+		size := min(*FlagPerBookBytes, len(data))
+		tail, prefix := data[len(data)-size:], data[:len(data)-size]
+		if len(prefix) > order {
+			prefix = prefix[len(prefix)-order:]
+		}
+		perplexities[files[i].Name] = Perplexity(autos, &files[i].Model, prefix, tail)
+	}
+	return perplexities
+}
+
+// Mix computes the convex combination alpha*auto + (1-alpha)*markov of two distributions
+func Mix(alpha float64, auto, markov []float64) []float64 {
+	mixed := make([]float64, 256)
+	for i := range mixed {
+		if i < len(auto) {
+			mixed[i] += alpha * auto[i]
+		}
+		if i < len(markov) {
+			mixed[i] += (1 - alpha) * markov[i]
+		}
+	}
+	return mixed
+}
+
+// Snapshot is a copy of the weights of the auto encoders and of their exponential moving averages if enabled
+type Snapshot struct {
+	Iterations []int
+	Weights    [][][]float64
+	Averages   [][][]float64
+}
+
+// NewSnapshot creates a new snapshot of the auto encoders
+func NewSnapshot(autos []Auto) Snapshot {
+	s := Snapshot{
+		Iterations: make([]int, len(autos)),
+		Weights:    make([][][]float64, len(autos)),
+		Averages:   make([][][]float64, len(autos)),
+	}
+	for i := range autos {
+		s.Iterations[i] = -1
+	}
+	s.Update(autos)
+	return s
+}
+
+// Update copies the weights of the auto encoders that changed since the last update
+func (s *Snapshot) Update(autos []Auto) {
+	for i := range autos {
+		if s.Iterations[i] == autos[i].Iteration {
+			continue
+		}
+		s.Iterations[i] = autos[i].Iteration
+		if s.Weights[i] == nil {
+			s.Weights[i] = make([][]float64, len(autos[i].Set.Weights))
+			s.Averages[i] = make([][]float64, len(autos[i].Set.Weights))
+		}
+		for ii, w := range autos[i].Set.Weights {
+			s.Weights[i][ii] = append(s.Weights[i][ii][:0], w.X...)
+			if len(w.States) > StateEMA {
+				s.Averages[i][ii] = append(s.Averages[i][ii][:0], w.States[StateEMA]...)
+			}
+		}
+	}
+}
+
+// Restore copies the snapshot back into the auto encoders, the averages are restored along with the weights so
+// that the average that is used after training is the one of the restored weights
+func (s *Snapshot) Restore(autos []Auto) {
+	for i := range autos {
+		if s.Iterations[i] == autos[i].Iteration {
+			continue
+		}
+		for ii, w := range autos[i].Set.Weights {
+			copy(w.X, s.Weights[i][ii])
+			if len(w.States) > StateEMA {
+				copy(w.States[StateEMA], s.Averages[i][ii])
+			}
+		}
+	}
+}
+
+// NewAuto creates a new randomly initialized auto encoder
+func NewAuto(rng *rand.Rand) Auto {
+	a := Auto{
+		Set: tf64.NewSet(),
+	}
+	hidden := *FlagHidden
+	a.Set.Add("l1", InputWidth(), hidden)
+	a.Set.Add("b1", hidden, 1)
+	if !*FlagTied {
+		a.Set.Add("l2", Activations[*FlagActivation].Width(hidden), 256)
+	}
+	a.Set.Add("b2", 256, 1)
+
+	for ii := range a.Set.Weights {
+		w := a.Set.Weights[ii]
+		if strings.HasPrefix(w.N, "b") {
+			w.X = w.X[:cap(w.X)]
+			w.States = make([][]float64, StateTotal)
+			for ii := range w.States {
+				w.States[ii] = make([]float64, len(w.X))
+			}
+			continue
+		}
+		factor := math.Sqrt(2.0 / float64(w.S[0]))
+		for range cap(w.X) {
+			w.X = append(w.X, rng.NormFloat64()*factor)
+		}
+		w.States = make([][]float64, StateTotal)
+		for ii := range w.States {
+			w.States[ii] = make([]float64, len(w.X))
+		}
+	}
+	return a
+}
+
+// TimingWindow is the number of steps in the moving average of the step latency
+const TimingWindow = 1024
+
+// Timing tracks the training throughput and a moving average of the step latency
+type Timing struct {
+	Start time.Time
+	Ring  [TimingWindow]time.Duration
+	Index int
+	Count int
+	Sum   time.Duration
+}
+
+// Add adds the latency of a step
+func (t *Timing) Add(latency time.Duration) {
+	if t.Count == TimingWindow {
+		t.Sum -= t.Ring[t.Index]
+	} else {
+		t.Count++
+	}
+	t.Ring[t.Index] = latency
+	t.Sum += latency
+	t.Index = (t.Index + 1) % TimingWindow
+}
+
+// Average is the moving average of the step latency
+func (t *Timing) Average() time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	return t.Sum / time.Duration(t.Count)
+}
+
+// String formats the throughput given the number of bytes processed and the average latency
+func (t *Timing) String(processed int) string {
+	rate := float64(processed) / time.Since(t.Start).Seconds()
+	return fmt.Sprintf("%.1f bytes/s %s/step", rate, t.Average())
+}
+
+// Inputs creates the input and the target of an auto encoder from a feature vector, the target is the label
+// smoothed distribution without the encoding of the position
+func Inputs(features []float64) tf64.Set {
+	others := tf64.NewSet()
+	others.Add("input", InputWidth(), 1)
+	others.Add("output", 256, 1)
+	in := others.ByName["input"]
+	out := others.ByName["output"]
+	in.X = append(in.X, features...)
+	out.X = append(out.X, Smooth(in.X[:min(len(in.X), 256)], *FlagLabelSmooth)...)
+	if InputClip != nil {
+		Clamp(in.X, InputClip[0], InputClip[1])
+	}
+	return others
+}
+
+// InputClip is the range that the inputs of the auto encoders are clamped to, nil disables clamping
+var InputClip *[2]float64
+
+// ParseRange parses a lo,hi range
+func ParseRange(spec string) (*[2]float64, error) {
+	low, high, ok := strings.Cut(spec, ",")
+	if !ok {
+		return nil, fmt.Errorf("%q is not lo,hi", spec)
+	}
+	var bounds [2]float64
+	for i, value := range []string{low, high} {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, err
+		}
+		bounds[i] = bound
+	}
+	if bounds[0] > bounds[1] {
+		return nil, fmt.Errorf("%g is greater than %g", bounds[0], bounds[1])
+	}
+	return &bounds, nil
+}
+
+// Clamp clamps the values to [lo, hi] in place
+func Clamp(values []float64, lo, hi float64) {
+	for i, value := range values {
+		values[i] = min(max(value, lo), hi)
+	}
+}
+
+// Smooth mixes a distribution with the uniform distribution, (1-eps)*target + eps/256
+func Smooth(target []float64, eps float64) []float64 {
+	smoothed := make([]float64, len(target))
+	for i, value := range target {
+		smoothed[i] = (1-eps)*value + eps/256
+	}
+	return smoothed
+}
+
+// Autos are auto encoders that are trained online along with the markov model they are conditioned on, the context
+// continues the stream that the markov model was counted from
+type Autos struct {
+	Autos   []Auto
+	Indexes [256]int
+	Model   *Model
+	Context Context
+	RNG     *rand.Rand
+}
+
+// NewOnline creates online auto encoders from auto encoders and a markov model
+func NewOnline(autos []Auto, model *Model, rng *rand.Rand) *Autos {
+	context := NewContext()
+	context.Markov = model.Markov
+	return &Autos{
+		Autos:   autos,
+		Indexes: Indexes(autos),
+		Model:   model,
+		Context: context,
+		RNG:     rng,
+	}
+}
+
+// Observe does one training step of the auto encoder of targetByte for the context and returns the loss,
+// the loss is 0 if targetByte doesn't have an auto encoder or is frozen. UpdateModel is called with targetByte
+// afterwards to advance the stream.
+func (a *Autos) Observe(targetByte byte) (loss float64) {
+	index := a.Indexes[targetByte]
+	if index < 0 || Frozen[targetByte] {
+		return 0
+	}
+	others := Inputs(OneHot(a.Context.Features(a.Model), targetByte))
+	return a.Autos[index].Update(&others, a.RNG)
+}
+
+// UpdateModel counts b in the markov model as a continuation of its stream and advances the context
+func (a *Autos) UpdateModel(b byte) {
+	a.Model.Ingest([]byte{b})
+	a.Context.Observe(b)
+}
+
+// Example is a training example of an auto encoder
+type Example struct {
+	// Index is the index of the auto encoder
+	Index int
+	// Others are the input and the target
+	Others tf64.Set
+	// Weight scales the learning rate
+	Weight float64
+	// Position is the position of the example in the training data
+	Position int
+}
+
+// Train trains the auto encoders on the data, stopping early if the validation loss stops improving
+func Train(autos []Auto, model *Model, train, validation []byte, rng *rand.Rand) error {
+	context := NewContext()
+	iteration := 0
+
+	best, bad := math.MaxFloat64, 0
+	var snapshot Snapshot
+	if *FlagPatience > 0 {
+		snapshot = NewSnapshot(autos)
+	}
+
+	context.Observe(0)
+	var timing Timing
+	if *FlagTiming {
+		timing.Start = time.Now()
+	}
+	start := time.Now()
+	indexes := Indexes(autos)
+	sample := Ingest([]byte(*FlagSamplePrompt))
+	if *FlagSamplePrompt == "" {
+		sample = Ingest([]byte(*FlagPrompt))
+	}
+	// update trains an auto encoder on an example and returns true if training should stop
+	update := func(example *Example) (bool, error) {
+		index := example.Index
+		var step time.Time
+		if *FlagTiming {
+			step = time.Now()
+		}
+		if *FlagBalanceLR || *FlagConfWeight {
+			rate := example.Weight
+			if *FlagBalanceLR {
+				rate *= BalancedRate(autos[index].Iteration+1, iteration+1, len(autos))
+			}
+			autos[index].Rate = rate
+		}
+		l := autos[index].Update(&example.Others, rng)
+		if math.IsNaN(l) || math.IsInf(l, 0) {
+			fmt.Fprintln(Stdout, iteration, l)
+			return true, fmt.Errorf("loss is not finite at iteration %d", iteration)
+		}
+		if *FlagTiming {
+			timing.Add(time.Since(step))
+		}
+		iteration++
+		if iteration%1024 == 0 || iteration < 1024 {
+			if *FlagTiming {
+				fmt.Fprintln(Stdout, iteration, l, timing.String(iteration))
+			} else {
+				fmt.Fprintln(Stdout, iteration, l)
+			}
+			// the progress of training is shown as it is made
+			Stdout.Flush()
+		}
+
+		// sampling only does forward passes, and it has its own random numbers so that training isn't changed
+		if *FlagSampleEvery > 0 && iteration%*FlagSampleEvery == 0 {
+			str, _ := Generate(autos, nil, model, sample, *FlagSampleLen, Recorder{}, rand.New(rand.NewSource(1)))
+			fmt.Fprintf(Stdout, "sample %d %q\n", iteration, str)
+		}
+
+		if *FlagPatience > 0 && iteration%*FlagEvalEvery == 0 {
+			v := Evaluate(autos, model, validation)
+			fmt.Fprintln(Stdout, "validation", iteration, v)
+			if v < best {
+				best, bad = v, 0
+				snapshot.Update(autos)
+			} else if bad++; bad >= *FlagPatience {
+				fmt.Fprintln(Stdout, "early stopping at iteration", iteration, "best validation loss", best)
+				snapshot.Restore(autos)
+				return true, nil
+			}
+		}
+
+		if Interrupted.Load() {
+			fmt.Fprintln(Stdout, "interrupted after", iteration, "iterations")
+			return true, nil
+		}
+		if *FlagMaxTime > 0 && iteration%MaxTimeEvery == 0 && time.Since(start) > *FlagMaxTime {
+			fmt.Fprintf(Stdout, "time limit reached after %d iterations, %.4f of the data was processed\n",
+				iteration, float64(example.Position+1)/float64(len(train)))
+			return true, nil
+		}
+		return false, nil
+	}
+
+	// a window of examples is trained on grouped by auto encoder, the order within a group is kept
+	var window []Example
+	flush := func() (bool, error) {
+		sort.SliceStable(window, func(i, j int) bool {
+			return window[i].Index < window[j].Index
+		})
+		for i := range window {
+			if stop, err := update(&window[i]); stop || err != nil {
+				return true, err
+			}
+		}
+		window = window[:0]
+		return false, nil
+	}
+
+	for i, value := range train {
+		index := indexes[value]
+		if Frozen[value] || index < 0 {
+			context.Observe(value)
+			continue
+		}
+		// the context is advanced for skipped examples so that the markov walk stays intact
+		if *FlagSubsample < 1 && rng.Float64() >= *FlagSubsample {
+			context.Observe(value)
+			continue
+		}
+
+		example := Example{
+			Index:    index,
+			Others:   Inputs(OneHot(context.Features(model), value)),
+			Weight:   1,
+			Position: i,
+		}
+		if *FlagConfWeight {
+			_, count := LookupCount(&context.Markov, model)
+			example.Weight = ConfidenceWeight(count)
+		}
+		context.Observe(value)
+
+		if *FlagChunked == 0 {
+			if stop, err := update(&example); stop || err != nil {
+				return err
+			}
+			continue
+		}
+		window = append(window, example)
+		if len(window) < *FlagChunked {
+			continue
+		}
+		if stop, err := flush(); stop || err != nil {
+			return err
+		}
+	}
+	if _, err := flush(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MaxTimeEvery is the number of iterations between checks of the training time limit
+const MaxTimeEvery = 64
+
+// Interrupted is set when training is interrupted, training stops at the next iteration
+var Interrupted atomic.Bool
+
+// File is an embedded book and its markov model
+type File struct {
+	Name  string
+	Data  []byte
+	Model Model
+}
+
+// Books are the names of the embedded books loaded by default, the first book is trained on
+var Books = []string{
+	"10.txt.utf-8.bz2",
+	"pg74.txt.bz2",
+	"76.txt.utf-8.bz2",
+	"84.txt.utf-8.bz2",
+	"100.txt.utf-8.bz2",
+	"1837.txt.utf-8.bz2",
+	"2701.txt.utf-8.bz2",
+	"3176.txt.utf-8.bz2",
+}
+
+// SelectBooks parses a comma separated list of embedded book names, all of the books are selected if empty
+func SelectBooks(spec string) ([]string, error) {
+	if spec == "" {
+		return Books, nil
+	}
+	entries, err := fs.ReadDir(Text, "books")
+	if err != nil {
+		return nil, err
+	}
+	available := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		available = append(available, entry.Name())
+	}
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(available, name) {
+			return nil, fmt.Errorf("unknown book %q, the available books are %s", name, strings.Join(available, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// LoadBooks loads the embedded books and builds their markov models
+func LoadBooks() ([]File, error) {
+	names, err := SelectBooks(*FlagBooks)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]File, len(names))
+	for i, name := range names {
+		files[i].Name = name
+	}
+
+	load := func(book *File) error {
+		if *FlagStream && book != &files[0] {
+			input, err := OpenBook(book.Name)
+			if err != nil {
+				return err
+			}
+			book.Model, err = NewModelReader(IngestReader{Reader: input})
+			return err
+		}
+		data, err := ReadBook(book.Name, *FlagCache)
+		if err != nil {
+			return err
+		}
+		data = Ingest(data)
+
+		book.Model = NewModel(data)
+		book.Data = data
+		return nil
+	}
+
+	workers := *FlagLoadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	type Result struct {
+		Index int
+		Err   error
+	}
+	jobs, results := make(chan int), make(chan Result)
+	for range workers {
+		go func() {
+			for i := range jobs {
+				results <- Result{Index: i, Err: load(&files[i])}
+			}
+		}()
+	}
+	go func() {
+		for i := range files {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	var errs []error
+	for range files {
+		result := <-results
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", files[result.Index].Name, result.Err))
+			continue
+		}
+		fmt.Fprintln(Stdout, files[result.Index].Name)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if *FlagConcat {
+		concat := File{Name: "concat"}
+		for i := range files {
+			if i > 0 {
+				concat.Data = append(concat.Data, byte(*FlagSeparator))
+			}
+			concat.Data = append(concat.Data, files[i].Data...)
+		}
+		concat.Model = NewModel(concat.Data)
+		files = append([]File{concat}, files...)
+		fmt.Fprintln(Stdout, concat.Name)
+	}
+	return files, nil
+}
+
+// GenerateMarkov generates size bytes from the prompt with the markov model
+func GenerateMarkov(model *Model, prompt []byte, size int, rng *rand.Rand) []byte {
+	str := append([]byte{}, prompt...)
+	markov := [order]Markov{}
+	for _, value := range str {
+		Iterate(&markov, value)
+	}
+	for range size {
+		symbol := SampleMarkov(&markov, model, rng)
+		str = append(str, symbol)
+		Iterate(&markov, symbol)
+	}
+	return str
+}
+
+// lossesToDistribution inverts the losses of the auto encoders into a probability distribution so that the auto
+// encoder with the lowest loss is the most probable, if all of the losses are equal the distribution is uniform
+func lossesToDistribution(losses []float64) []float64 {
+	distribution := make([]float64, len(losses))
+	max := 0.0
+	for _, value := range losses {
+		if value > max {
+			max = value
+		}
+	}
+	sum := 0.0
+	for i, value := range losses {
+		value = max - value
+		sum += value
+		distribution[i] = value
+	}
+	if sum == 0 {
+		for i := range distribution {
+			distribution[i] = 1 / float64(len(distribution))
+		}
+		return distribution
+	}
+	for i, value := range distribution {
+		distribution[i] = value / sum
+	}
+	return distribution
+}
+
+// Predict computes the distribution of the next symbol from the losses of the auto encoders mixed with the markov model,
+// symbols without an auto encoder only get probability from the markov model
+func Predict(autos []Auto, context *Context, model *Model) []float64 {
+	return Mix(*FlagMix, PredictAutos(autos, context, model), PredictMarkov(context, model))
+}
+
+// PredictAutos computes the distribution of the next symbol from the losses of the auto encoders
+func PredictAutos(autos []Auto, context *Context, model *Model) []float64 {
+	return AutoDistribution(autos, context.Features(model))
+}
+
+// AutoDistribution computes the distribution of the next symbol from the losses of the auto encoders for a
+// feature vector
+func AutoDistribution(autos []Auto, features []float64) []float64 {
+	symbols, losses := AutoLosses(autos, features)
+	return LossDistribution(symbols, losses, nil)
+}
+
+// AutoLosses computes the reconstruction loss of the auto encoder of each symbol that has one for a feature vector,
+// the shared auto encoder is evaluated with the one hot encoding of each symbol
+func AutoLosses(autos []Auto, features []float64) ([]byte, []float64) {
+	symbols := make([]byte, len(autos))
+	for i, a := range autos {
+		symbols[i] = a.Symbol
+	}
+	if *FlagShared {
+		symbols = Symbols()
+	}
+	indexes := Indexes(autos)
+	distribution := make([]float64, len(symbols))
+	for i, symbol := range symbols {
+		a := &autos[indexes[symbol]]
+		others := Inputs(OneHot(features, symbol))
+		loss := a.Loss(&others, false, nil)
+
+		a.Set.Zero()
+		others.Zero()
+		loss(func(a *tf64.V) bool {
+			distribution[i] = a.X[0]
+			return true
+		})
+	}
+	return symbols, distribution
+}
+
+// LossDistribution computes the distribution of the next symbol from the losses of the auto encoders of the symbols,
+// pruned symbols get a fixed low probability, pruned can be nil if none were pruned
+func LossDistribution(symbols []byte, losses []float64, pruned *[256]bool) []float64 {
+	probabilities := lossesToDistribution(losses)
+	distribution := make([]float64, 256)
+	for i, probability := range probabilities {
+		distribution[symbols[i]] = probability
+	}
+	if pruned == nil {
+		return distribution
+	}
+	count := 0
+	for _, ok := range pruned {
+		if ok {
+			count++
+		}
+	}
+	if count == 0 {
+		return distribution
+	}
+	scale := 1 - float64(count)*PrunedProbability
+	for i := range distribution {
+		if pruned[i] {
+			distribution[i] = PrunedProbability
+			continue
+		}
+		distribution[i] *= scale
+	}
+	return distribution
+}
+
+// PrunedProbability is the probability of the next symbol given to each symbol whose auto encoder was pruned
+const PrunedProbability = 1e-6
+
+// PruneUntrained drops the auto encoders that were never updated and returns the rest along with the symbols that
+// were pruned, the shared auto encoder is never pruned
+func PruneUntrained(autos []Auto) ([]Auto, *[256]bool) {
+	var pruned [256]bool
+	if *FlagShared {
+		return autos, &pruned
+	}
+	trained := make([]Auto, 0, len(autos))
+	for _, a := range autos {
+		if a.Iteration == 0 {
+			pruned[a.Symbol] = true
+			continue
+		}
+		trained = append(trained, a)
+	}
+	return trained, &pruned
+}
+
+// PredictMarkov computes the distribution of the next symbol from the markov model
+func PredictMarkov(context *Context, model *Model) []float64 {
+	vector := context.Condition(model)
+	distribution := make([]float64, len(vector))
+	for i, value := range vector {
+		distribution[i] = float64(value)
+	}
+	return distribution
+}
+
+// Explain prints the n auto encoders with the highest probability for a generation step
+func Explain(step int, distribution []float64, n int) {
+	vector := make([]float32, len(distribution))
+	for i, value := range distribution {
+		vector[i] = float32(value)
+	}
+	fmt.Fprintf(Stdout, "step %-4d", step)
+	for _, value := range Top(vector, n) {
+		fmt.Fprintf(Stdout, " %s:%.4f", Symbol(value.Byte), value.Prob)
+	}
+	fmt.Fprintln(Stdout)
+}
+
+// Stdout is the buffered standard output that all output is written to, it is flushed before exiting
+var Stdout = bufio.NewWriter(os.Stdout)
+
+// Streamer writes generated bytes as they are generated and flushes after every Every bytes
+type Streamer struct {
+	Writer *bufio.Writer
+	Every  int
+	Count  int
+}
+
+// WriteByte writes a generated byte and flushes if Every bytes were written since the last flush
+func (s *Streamer) WriteByte(b byte) error {
+	if err := s.Writer.WriteByte(b); err != nil {
+		return err
+	}
+	if s.Count++; s.Count%s.Every == 0 {
+		return s.Writer.Flush()
+	}
+	return nil
+}
+
+// Stream streams the generated bytes if it isn't nil
+var Stream *Streamer
+
+// Step is the sampling distribution of a generation step and the byte that was selected
+type Step struct {
+	Step         int       `json:"step"`
+	Byte         byte      `json:"byte"`
+	Distribution []float64 `json:"distribution"`
+}
+
+// Trace is why a byte was generated
+type Trace struct {
+	Step int `json:"step"`
+	// Context is the highest order markov context, oldest byte first
+	Context []string `json:"context"`
+	// Entropy is the entropy in bits of the lookup vector of the context
+	Entropy float64 `json:"entropy"`
+	// Loss is the loss of the auto encoder of the selected byte, it is missing if the byte has no auto encoder
+	Loss *float64 `json:"loss,omitempty"`
+	// Top are the most probable bytes of the sampling distribution
+	Top  []Next `json:"top"`
+	Byte byte   `json:"byte"`
+}
+
+// NewTrace creates the trace of a generation step from the context before the byte is selected
+func NewTrace(step int, markov *[order]Markov, model *Model) Trace {
+	trace := Trace{Step: step}
+	for i := order - 1; i >= 0; i-- {
+		trace.Context = append(trace.Context, Symbol(markov[order-1][i]))
+	}
+	for _, probability := range Lookup(markov, model) {
+		if probability > 0 {
+			trace.Entropy -= float64(probability) * math.Log2(float64(probability))
+		}
+	}
+	return trace
+}
+
+// Recorder records the sampling distributions and the traces of the generation steps, a nil encoder records nothing
+type Recorder struct {
+	Steps  *json.Encoder
+	Traces *json.Encoder
+}
+
+// Generate generates size bytes from the prompt with the auto encoders, the score is the log likelihood of the
+// generated symbols under the markov model. The steps are recorded with the recorder.
+func Generate(autos []Auto, pruned *[256]bool, model *Model, prompt []byte, size int, recorder Recorder,
+	rng *rand.Rand) ([]byte, float64) {
+	str := append([]byte{}, prompt...)
+	score := 0.0
+	context := NewContext()
+	for _, value := range str {
+		context.Observe(value)
+	}
+	for step := range size {
+		symbols, losses := AutoLosses(autos, context.Features(model))
+		auto := LossDistribution(symbols, losses, pruned)
+		var trace Trace
+		if recorder.Traces != nil {
+			trace = NewTrace(step, &context.Markov, model)
+		}
+		if *FlagExplain {
+			Explain(step, auto, *FlagTop)
+		}
+		markov := PredictMarkov(&context, model)
+		distribution := Mix(*FlagMix, auto, markov)
+		total, selected := 0.0, rng.Float64()
+		for i, value := range distribution {
+			total += value
+			if selected < total {
+				score += math.Log(math.Max(markov[i], 1e-9))
+				str = append(str, byte(i))
+				context.Observe(byte(i))
+				if Stream != nil {
+					if err := Stream.WriteByte(byte(i)); err != nil {
+						fmt.Fprintln(os.Stderr, "flushevery:", err)
+						Stream = nil
+					}
+				}
+				if recorder.Steps != nil {
+					if err := recorder.Steps.Encode(Step{Step: step, Byte: byte(i), Distribution: distribution}); err != nil {
+						fmt.Fprintln(os.Stderr, "probsout:", err)
+						recorder.Steps = nil
+					}
+				}
+				if recorder.Traces != nil {
+					trace.Byte = byte(i)
+					if index := slices.Index(symbols, byte(i)); index >= 0 {
+						trace.Loss = &losses[index]
+					}
+					vector := make([]float32, len(distribution))
+					for i, value := range distribution {
+						vector[i] = float32(value)
+					}
+					trace.Top = Top(vector, *FlagTop)
+					if err := recorder.Traces.Encode(trace); err != nil {
+						fmt.Fprintln(os.Stderr, "trace:", err)
+						recorder.Traces = nil
+					}
+				}
+				break
+			}
+		}
+	}
+	return str, score
+}
+
+// GenerateBest generates size bytes n times from the prompt and returns the generation with the highest score, the
+// steps of each generation are buffered so that only those of the returned generation are recorded
+func GenerateBest(autos []Auto, pruned *[256]bool, model *Model, prompt []byte, size, n int, recorder Recorder,
+	rng *rand.Rand) []byte {
+	var best []byte
+	var bestSteps, bestTraces *bytes.Buffer
+	score := math.Inf(-1)
+	for range n {
+		steps, traces := &bytes.Buffer{}, &bytes.Buffer{}
+		var buffered Recorder
+		if recorder.Steps != nil {
+			buffered.Steps = json.NewEncoder(steps)
+		}
+		if recorder.Traces != nil {
+			buffered.Traces = json.NewEncoder(traces)
+		}
+		str, s := Generate(autos, pruned, model, prompt, size, buffered, rng)
+		if best == nil || s > score {
+			best, score = str, s
+			bestSteps, bestTraces = steps, traces
+		}
+	}
+	if recorder.Steps != nil {
+		if err := Replay(recorder.Steps, bestSteps); err != nil {
+			fmt.Fprintln(os.Stderr, "probsout:", err)
+		}
+	}
+	if recorder.Traces != nil {
+		if err := Replay(recorder.Traces, bestTraces); err != nil {
+			fmt.Fprintln(os.Stderr, "trace:", err)
+		}
+	}
+	return best
+}
+
+// Replay encodes the json lines of a buffer with an encoder
+func Replay(encoder *json.Encoder, buffer *bytes.Buffer) error {
+	decoder := json.NewDecoder(buffer)
+	for decoder.More() {
+		var record json.RawMessage
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Command is a subcommand
+type Command struct {
+	Name  string
+	Usage string
+	Flags []string
+	Run   func(set *flag.FlagSet)
+}
+
+var (
+	// BookFlags are the flags used for loading the books
+	BookFlags = []string{"config", "books", "cache", "loadworkers", "stream", "memstats", "maxmodelmem", "savemodel", "concat",
+		"separator", "reseton", "lowercase"}
+	// Commands are the subcommands, running without a subcommand trains and then generates
+	Commands = []Command{
+		{
+			Name:  "train",
+			Usage: "train the auto encoders and save them",
+			Flags: slices.Concat(BookFlags, []string{"activation", "hidden", "dropout", "patience", "evalevery", "validbytes",
+				"trainbytes", "trainoffset", "vocab", "shared", "tied", "eta", "grid", "gridbytes", "gridmetric", "features", "labelsmooth", "pos", "inputclip", "denoise", "balancelr", "confweight", "chunked", "ema", "maxtime", "sampleevery", "samplelen", "sampleprompt", "prompt", "subsample", "freeze", "warmstart", "frombaseline", "timing", "save", "quantize", "exportjson", "exportonnx", "dryrun", "bpb", "orderablation", "perbook", "perbookbytes",
+				"dumpweights", "dumpauto"}),
+			Run: runTrain,
+		},
+		{
+			Name:  "generate",
+			Usage: "generate text from saved auto encoders or a baseline",
+			Flags: slices.Concat(BookFlags, []string{"load", "importjson", "activation", "baseline", "mix", "metrics", "prompt", "promptfile",
+				"output", "mixbooks", "explain", "top", "features", "probsout", "continuetail", "bestof", "pos", "inputclip", "labelsmooth", "shared", "prune", "coverage", "flushevery", "trace", "n", "promptsfile", "out",
+				"trainbytes", "trainoffset"}),
+			Run: runGenerate,
+		},
+		{
+			Name:  "eval",
+			Usage: "evaluate saved auto encoders on the held out validation slice",
+			Flags: slices.Concat(BookFlags, []string{"load", "importjson", "activation", "mix", "validbytes", "trainbytes", "trainoffset", "top",
+				"features", "labelsmooth", "bpb", "pos", "inputclip", "shared", "orderablation"}),
+			Run: runEval,
+		},
+		{
+			Name:  "inspect",
+			Usage: "print the most probable continuations of a context",
+			Flags: slices.Concat(BookFlags, []string{"inspect", "top", "stats", "orderablation", "validbytes", "trainbytes", "trainoffset"}),
+			Run:   runInspect,
+		},
+		{
+			Name:  "diff",
+			Usage: "compare the layers of two saved auto encoders: diff a.ckpt b.ckpt",
+			Run:   runDiff,
+		},
+	}
+)
+
+// FlagSet creates a flag set with the flags of the command, the values are shared with the global flags
+func (c Command) FlagSet() *flag.FlagSet {
+	set := flag.NewFlagSet(c.Name, flag.ExitOnError)
+	for _, name := range c.Flags {
+		f := flag.Lookup(name)
+		set.Var(f.Value, f.Name, f.Usage)
+	}
+	return set
+}
+
+// fatal flushes stdout, prints the error, and exits
+func fatal(err error) {
+	Stdout.Flush()
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// configure applies the config file and the context resets
+func configure(set *flag.FlagSet) {
+	if *FlagConfig != "" {
+		options, err := LoadOptions(*FlagConfig)
+		if err == nil {
+			err = options.Apply(set)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *FlagLoad != "" && *FlagImportJSON != "" {
+		fatal(errors.New("load and importjson are mutually exclusive"))
+	}
+	if *FlagSampleEvery < 0 {
+		fatal(errors.New("sampleevery must not be negative"))
+	}
+	if *FlagSampleLen < 0 {
+		fatal(errors.New("samplelen must not be negative"))
+	}
+	if *FlagExportONNX != "" && !*FlagShared {
+		fatal(errors.New("exportonnx needs shared, there is one network to export"))
+	}
+	if *FlagEta <= 0 {
+		fatal(errors.New("eta must be positive"))
+	}
+	if *FlagGridMetric != "perplexity" && *FlagGridMetric != "loss" {
+		fatal(fmt.Errorf("unknown gridmetric %q", *FlagGridMetric))
+	}
+	if *FlagFromBaseline {
+		if *FlagWarmStart {
+			fatal(errors.New("frombaseline and warmstart are mutually exclusive"))
+		}
+		// the markov features are non-negative, so everett and relu pass them through but tanh squashes them
+		if *FlagActivation == "tanh" {
+			fatal(errors.New("frombaseline needs an activation that passes non-negative inputs through: everett or relu"))
+		}
+		if *FlagHidden < 256 {
+			fatal(errors.New("frombaseline needs a hidden layer at least as wide as the 256 markov features"))
+		}
+	}
+	if *FlagFlushEvery < 0 {
+		fatal(errors.New("flushevery must not be negative"))
+	}
+	if *FlagFlushEvery > 0 {
+		if *FlagOutput != "utf8" && *FlagOutput != "raw" {
+			fatal(errors.New("flushevery needs utf8 or raw output, encodings are applied to the whole generation"))
+		}
+		if *FlagBestOf != 1 {
+			fatal(errors.New("flushevery can't be used with bestof, the best generation is only known at the end"))
+		}
+		if *FlagExplain {
+			fatal(errors.New("flushevery can't be used with explain, the explanations would be mixed into the streamed bytes"))
+		}
+	}
+	if *FlagN < 0 {
+		fatal(errors.New("n must not be negative"))
+	}
+	if *FlagChunked < 0 {
+		fatal(errors.New("chunked must not be negative"))
+	}
+	if *FlagPatience > 0 && *FlagEvalEvery < 1 {
+		fatal(errors.New("evalevery must be positive when patience is set"))
+	}
+	if *FlagValidBytes < 0 {
+		fatal(errors.New("validbytes must not be negative"))
+	}
+	if *FlagPerBookBytes < 1 {
+		fatal(errors.New("perbookbytes must be positive"))
+	}
+	if *FlagTop < 0 {
+		fatal(errors.New("top must not be negative"))
+	}
+	if *FlagTied {
+		if width := Activations[*FlagActivation].Width(*FlagHidden); width != *FlagHidden {
+			fatal(fmt.Errorf("tied needs an activation that keeps the width of the hidden layer, %s doubles it",
+				*FlagActivation))
+		}
+		if InputWidth() != 256 {
+			fatal(errors.New("tied can't be used with pos or shared, the input has to be as wide as the output"))
+		}
+	}
+	if *FlagShared && *FlagVocab {
+		fatal(errors.New("shared can't be used with vocab, the shared auto encoder covers every symbol"))
+	}
+	if _, ok := Activations[*FlagActivation]; !ok {
+		fatal(fmt.Errorf("unknown activation %q", *FlagActivation))
+	}
+	if *FlagHidden < 1 {
+		fatal(errors.New("hidden must be positive"))
+	}
+	if *FlagMaxModelMem < 0 {
+		fatal(errors.New("maxmodelmem must not be negative"))
+	}
+	if *FlagFeatures != "markov" && *FlagFeatures != "histogram" {
+		fatal(fmt.Errorf("unknown features %q", *FlagFeatures))
+	}
+	if *FlagDenoise < 0 {
+		fatal(errors.New("denoise must not be negative"))
+	}
+	if *FlagEMA < 0 || *FlagEMA >= 1 {
+		fatal(errors.New("ema must be at least 0 and less than 1"))
+	}
+	if *FlagSubsample <= 0 || *FlagSubsample > 1 {
+		fatal(errors.New("subsample must be greater than 0 and at most 1"))
+	}
+	if *FlagLabelSmooth < 0 || *FlagLabelSmooth > 1 {
+		fatal(errors.New("labelsmooth must be between 0 and 1"))
+	}
+	if _, ok := Encodings[*FlagOutput]; !ok && *FlagOutput != "utf8" && *FlagOutput != "raw" {
+		fatal(fmt.Errorf("unknown output %q", *FlagOutput))
+	}
+	if *FlagStream && *FlagConcat {
+		fatal(errors.New("stream can't be used with concat, which needs the data of every book"))
+	}
+	if *FlagConcat {
+		if *FlagSeparator < 0 || *FlagSeparator > 255 {
+			fatal(errors.New("separator must be a byte value between 0 and 255"))
+		}
+		Resets[*FlagSeparator] = true
+	}
+	frozen, err := ParseRanges(*FlagFreeze)
+	if err != nil {
+		fatal(fmt.Errorf("invalid freeze: %w", err))
+	}
+	Frozen = frozen
+	if *FlagInputClip != "" {
+		clip, err := ParseRange(*FlagInputClip)
+		if err != nil {
+			fatal(fmt.Errorf("invalid inputclip: %w", err))
+		}
+		InputClip = clip
+	}
+	if *FlagLowercase {
+		Transform = Lowercase
+	}
+	if *FlagResetOn != "" {
+		symbols, err := strconv.Unquote(`"` + *FlagResetOn + `"`)
+		if err != nil {
+			fatal(fmt.Errorf("invalid reseton %q: %w", *FlagResetOn, err))
+		}
+		for _, symbol := range []byte(symbols) {
+			Resets[symbol] = true
+		}
+	}
+}
+
+// loadBooks loads the books or exits
+func loadBooks() []File {
+	files, err := LoadBooks()
+	if err != nil {
+		fatal(err)
+	}
+	memStats("loading")
+	if *FlagSaveModel != "" {
+		if err := SaveModel(*FlagSaveModel, &files[0].Model); err != nil {
+			fatal(err)
+		}
+	}
+	return files
+}
+
+// memStats prints the memory usage if enabled
+func memStats(after string) {
+	if !*FlagMemStats {
+		return
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	fmt.Fprintf(Stdout, "memory after %s: heap=%dMB sys=%dMB\n", after, stats.HeapAlloc/(1024*1024), stats.Sys/(1024*1024))
+}
+
+// readPrompt reads the prompt from the prompt or promptfile flags, or takes the tail of the training data
+func readPrompt(set *flag.FlagSet, files []File) []byte {
+	explicit := false
+	set.Visit(func(f *flag.Flag) {
+		if f.Name == "prompt" {
+			explicit = true
+		}
+	})
+	if *FlagContinueTail {
+		if explicit || *FlagPromptFile != "" {
+			fatal(errors.New("continuetail is mutually exclusive with prompt and promptfile"))
+		}
+		data, _ := split(files)
+		size := order
+		if *FlagFeatures == "histogram" {
+			size = HistogramSize
+		}
+		size = min(size, len(data))
+		return append([]byte{}, data[len(data)-size:]...)
+	}
+	if *FlagPromptFile == "" {
+		return Ingest([]byte(*FlagPrompt))
+	}
+	if explicit {
+		fatal(errors.New("prompt and promptfile are mutually exclusive"))
+	}
+	data, err := os.ReadFile(*FlagPromptFile)
+	if err != nil {
+		fatal(err)
+	}
+	return Ingest(data)
+}
+
+// baseline generates from the baseline model if one is selected
+func baseline(files []File, prompt []byte, rng *rand.Rand) bool {
+	switch *FlagBaseline {
+	case "":
+		return false
+	case "markov":
+		mixBooks(files)
+		generate := func(prompt []byte) []byte {
+			return GenerateMarkov(&files[0].Model, prompt, *FlagN, rng)
+		}
+		if *FlagPromptsFile != "" {
+			generateBatch(generate)
+			return true
+		}
+		output(generate(prompt), len(prompt), false)
+		return true
+	}
+	fatal(fmt.Errorf("unknown baseline %q", *FlagBaseline))
+	return false
+}
+
+// split splits the first book into the training window and the held out validation slice that follows it
+func split(files []File) (data, validation []byte) {
+	if *FlagTrainOffset < 0 || *FlagTrainBytes < 0 {
+		fatal(errors.New("trainoffset and trainbytes must not be negative"))
+	}
+	if end := *FlagTrainOffset + *FlagTrainBytes; end > len(files[0].Data) {
+		fatal(fmt.Errorf("trainoffset+trainbytes=%d exceeds the %d bytes of %s",
+			end, len(files[0].Data), files[0].Name))
+	}
+	data = files[0].Data[*FlagTrainOffset : *FlagTrainOffset+*FlagTrainBytes]
+
+	validation = files[0].Data[*FlagTrainOffset+*FlagTrainBytes:]
+	if len(validation) > *FlagValidBytes {
+		validation = validation[:*FlagValidBytes]
+	}
+	return data, validation
+}
+
+// DryRunSteps is the number of training steps timed by a dry run
+const DryRunSteps = 100
+
+// dryRun prints the resolved configuration and an estimate of the training time measured with a short probe
+func dryRun(set *flag.FlagSet, files []File) {
+	fmt.Fprintln(Stdout, "configuration")
+	set.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(Stdout, "  %-12s %s\n", f.Name, f.Value)
+	})
+	data, _ := split(files)
+
+	rng := rand.New(rand.NewSource(1))
+	parameters := 0
+	for _, w := range NewAuto(rng).Set.Weights {
+		parameters += len(w.X)
+	}
+	contexts := 0
+	for i := range files[0].Model.Counts {
+		contexts += len(files[0].Model.Counts[i])
+	}
+	count := 256
+	if *FlagShared {
+		count = 1
+	}
+	// weights, gradients, and the two adam states are all float64
+	memory := count * parameters * 4 * 8
+	// each context has 256 uint32 counts
+	memory += contexts * 256 * 4
+	fmt.Fprintf(Stdout, "  %-12s %d\n", "order", order)
+	fmt.Fprintf(Stdout, "  %-12s adam b1=%g b2=%g eta=%g\n", "optimizer", B1, B2, *FlagEta)
+	fmt.Fprintf(Stdout, "  %-12s %d per auto encoder, %d total\n", "parameters", parameters, count*parameters)
+	fmt.Fprintf(Stdout, "  %-12s %d\n", "contexts", contexts)
+	fmt.Fprintf(Stdout, "  %-12s %.1f MiB\n", "memory", float64(memory)/(1024*1024))
+
+	probe := data
+	if len(probe) > DryRunSteps {
+		probe = probe[:DryRunSteps]
+	}
+	if len(probe) == 0 {
+		fmt.Fprintln(Stdout, "no training data to probe")
+		return
+	}
+	autos := make([]Auto, count)
+	index := func(value byte) int {
+		if *FlagShared {
+			return 0
+		}
+		return int(value)
+	}
+	for _, value := range probe {
+		if autos[index(value)].Set.ByName == nil {
+			autos[index(value)] = NewAuto(rng)
+		}
+	}
+	context := NewContext()
+	start := time.Now()
+	for _, value := range probe {
+		others := Inputs(OneHot(context.Features(&files[0].Model), value))
+		autos[index(value)].Update(&others, rng)
+		context.Observe(value)
+	}
+	elapsed := time.Since(start)
+	rate := float64(len(probe)) / elapsed.Seconds()
+	estimate := time.Duration(float64(len(data)) / rate * float64(time.Second))
+	fmt.Fprintf(Stdout, "  %-12s %.1f steps/s over %d steps\n", "rate", rate, len(probe))
+	fmt.Fprintf(Stdout, "  %-12s %s for %d bytes\n", "estimate", estimate.Round(time.Second), len(data))
+}
+
+// train creates and trains the auto encoders
+func train(files []File, rng *rand.Rand) []Auto {
+	data, validation := split(files)
+	symbols := Symbols()
+	if *FlagVocab {
+		symbols = Vocabulary(data)
+		fmt.Fprintln(Stdout, "vocabulary", len(symbols))
+	}
+	autos := NewAutos(symbols, rng)
+	if *FlagWarmStart {
+		for i := range autos {
+			autos[i].Identity(WarmStartNoise)
+		}
+	}
+	if *FlagFromBaseline {
+		for i := range autos {
+			autos[i].Identity(0)
+		}
+	}
+	if *FlagEMA > 0 {
+		for i := range autos {
+			autos[i].EnableEMA()
+		}
+	}
+	// the first interrupt stops training so that a checkpoint can be saved, the second exits immediately
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		Interrupted.Store(true)
+		<-interrupts
+		os.Exit(1)
+	}()
+	err := Train(autos, &files[0].Model, data, validation, rng)
+	signal.Stop(interrupts)
+	if err != nil {
+		fatal(err)
+	}
+	if *FlagEMA > 0 {
+		// the raw weights are kept in the state of the average
+		for i := range autos {
+			autos[i].SwapEMA()
+		}
+	}
+	if Interrupted.Load() {
+		save(autos)
+		Stdout.Flush()
+		os.Exit(0)
+	}
+	return autos
+}
+
+// GridAxis is a flag and the values that it takes in a grid search
+type GridAxis struct {
+	Name   string
+	Values []string
+}
+
+// ParseGrid parses a grid of semicolon separated flags with comma separated values, e.g. eta=1e-2,1e-3;hidden=128,256
+func ParseGrid(spec string) ([]GridAxis, error) {
+	var axes []GridAxis
+	for _, axis := range strings.Split(spec, ";") {
+		name, values, ok := strings.Cut(strings.TrimSpace(axis), "=")
+		if !ok || name == "" || values == "" {
+			return nil, fmt.Errorf("%q is not flag=value,value", axis)
+		}
+		axes = append(axes, GridAxis{Name: name, Values: strings.Split(values, ",")})
+	}
+	return axes, nil
+}
+
+// Configurations are the combinations of the values of the axes, the last axis varies fastest
+func Configurations(axes []GridAxis) [][]string {
+	configurations := [][]string{{}}
+	for _, axis := range axes {
+		var next [][]string
+		for _, configuration := range configurations {
+			for _, value := range axis.Values {
+				next = append(next, append(slices.Clone(configuration), value))
+			}
+		}
+		configurations = next
+	}
+	return configurations
+}
+
+// grid trains each configuration of the grid on the same budget with the same seed and prints the configurations
+// sorted by their validation metric
+func grid(set *flag.FlagSet, files []File) {
+	axes, err := ParseGrid(*FlagGrid)
+	if err != nil {
+		fatal(fmt.Errorf("invalid grid: %w", err))
+	}
+	if *FlagGridBytes < 1 {
+		fatal(errors.New("gridbytes must be positive"))
+	}
+	if err := set.Set("trainbytes", strconv.Itoa(*FlagGridBytes)); err != nil {
+		fatal(err)
+	}
+	type Result struct {
+		Configuration string
+		Metric        float64
+	}
+	var results []Result
+	for _, configuration := range Configurations(axes) {
+		names := make([]string, len(axes))
+		for i, axis := range axes {
+			if err := set.Set(axis.Name, configuration[i]); err != nil {
+				fatal(fmt.Errorf("invalid grid: %w", err))
+			}
+			names[i] = axis.Name + "=" + configuration[i]
+		}
+		configure(set)
+		name := strings.Join(names, " ")
+		fmt.Fprintln(Stdout, "grid", name)
+		autos := train(files, rand.New(rand.NewSource(1)))
+		data, validation := split(files)
+		metric := 0.0
+		switch *FlagGridMetric {
+		case "perplexity":
+			metric = Perplexity(autos, &files[0].Model, data, validation)
+		case "loss":
+			metric = Evaluate(autos, &files[0].Model, validation)
+		}
+		results = append(results, Result{Configuration: name, Metric: metric})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Metric < results[j].Metric
+	})
+	fmt.Fprintf(Stdout, "%-40s %s\n", "configuration", *FlagGridMetric)
+	for _, result := range results {
+		fmt.Fprintf(Stdout, "%-40s %f\n", result.Configuration, result.Metric)
+	}
+}
+
+// load loads the auto encoders
+func load() []Auto {
+	path, loader := *FlagLoad, LoadAutos
+	if *FlagImportJSON != "" {
+		path, loader = *FlagImportJSON, ImportJSON
+	}
+	autos, err := loader(path)
+	if err != nil {
+		fatal(err)
+	}
+	activation := Activations[*FlagActivation]
+	for _, a := range autos {
+		l1, l2 := a.Set.ByName["l1"], a.Set.ByName["l2"]
+		if l1 == nil {
+			fatal(fmt.Errorf("%s does not have l1 weights", path))
+		}
+		// tied weights don't have l2, the decoder is the transpose of l1
+		width := l1.S[1]
+		if l2 != nil {
+			width = l2.S[0]
+		}
+		if width != activation.Width(l1.S[1]) {
+			fatal(fmt.Errorf("%s does not match the %s activation", path, *FlagActivation))
+		}
+		if l1.S[0] != InputWidth() {
+			fatal(fmt.Errorf("%s has an input width of %d, pos and shared need to match", path, l1.S[0]))
+		}
+	}
+	return autos
+}
+
+// loading is true if the auto encoders are loaded instead of trained
+func loading() bool {
+	return *FlagLoad != "" || *FlagImportJSON != ""
+}
+
+// save saves and exports the auto encoders if the paths are set
+func save(autos []Auto) {
+	if *FlagExportJSON != "" {
+		if err := ExportJSON(*FlagExportJSON, autos); err != nil {
+			fatal(err)
+		}
+	}
+	if *FlagExportONNX != "" {
+		if err := ExportONNX(*FlagExportONNX, &autos[0], *FlagActivation); err != nil {
+			fatal(err)
+		}
+	}
+	if *FlagSave == "" {
+		return
+	}
+	quantization, err := SaveAutos(*FlagSave, autos, *FlagQuantize)
+	if err != nil {
+		fatal(err)
+	}
+	if *FlagQuantize != "" {
+		fmt.Fprintln(Stdout, "quantization error", quantization)
+	}
+}
+
+// Encodings are the encodings of the generated text by name
+var Encodings = map[string]func(generated []byte) string{
+	"hex":    hex.EncodeToString,
+	"base64": base64.StdEncoding.EncodeToString,
+}
+
+// dumpWeights writes a heatmap of the l1 weights of the selected auto encoder if enabled
+func dumpWeights(autos []Auto) {
+	if *FlagDumpWeights == "" {
+		return
+	}
+	if *FlagDumpAuto < 0 || *FlagDumpAuto > 255 {
+		fatal(errors.New("dumpauto must be a byte value between 0 and 255"))
+	}
+	index := Indexes(autos)[*FlagDumpAuto]
+	if index < 0 {
+		fatal(fmt.Errorf("there is no auto encoder for %s", Symbol(byte(*FlagDumpAuto))))
+	}
+	if err := WriteWeightHeatmap(autos[index].Set.ByName["l1"], *FlagDumpWeights); err != nil {
+		fatal(err)
+	}
+}
+
+// output prints the generated text and its metrics, an encoding is only applied to the generated part so that the
+// prompt stays readable and raw output writes the bytes unmodified. Streamed text was already written as it was
+// generated, so only the end of the line is written.
+func output(str []byte, prompt int, streamed bool) {
+	switch {
+	case streamed && *FlagOutput == "utf8":
+		fmt.Fprintln(Stdout)
+	case streamed:
+	case *FlagOutput == "utf8":
+		fmt.Fprintln(Stdout, string(str))
+	case *FlagOutput == "raw":
+		Stdout.Write(str)
+	default:
+		fmt.Fprintln(Stdout, string(str[:prompt]), Encodings[*FlagOutput](str[prompt:]))
+	}
+	if *FlagMetrics {
+		fmt.Fprintln(Stdout, OutputStats(str[prompt:]))
+	}
+}
+
+// mixBooks conditions generation on the mixture of books if there is one
+func mixBooks(files []File) {
+	if *FlagMixBooks == "" {
+		return
+	}
+	mixture, err := ParseMixture(*FlagMixBooks, files)
+	if err != nil {
+		fatal(fmt.Errorf("invalid mixbooks: %w", err))
+	}
+	Mixture = mixture
+}
+
+// generate generates from the auto encoders
+func generate(autos []Auto, files []File, prompt []byte, rng *rand.Rand) {
+	if *FlagMix < 0 || *FlagMix > 1 {
+		fatal(errors.New("mix must be between 0 and 1"))
+	}
+	if *FlagBestOf < 1 {
+		fatal(errors.New("bestof must be positive"))
+	}
+	mixBooks(files)
+	var pruned *[256]bool
+	if *FlagPrune {
+		count := len(autos)
+		autos, pruned = PruneUntrained(autos)
+		fmt.Fprintln(Stdout, "pruned", count-len(autos), "untrained auto encoders")
+	}
+	if *FlagPromptsFile != "" {
+		generateBatch(func(prompt []byte) []byte {
+			return GenerateBest(autos, pruned, &files[0].Model, prompt, *FlagN, *FlagBestOf, Recorder{}, rng)
+		})
+		return
+	}
+	var probs, traces *os.File
+	var writer, tracer *bufio.Writer
+	var recorder Recorder
+	if *FlagProbsOut != "" {
+		var err error
+		probs, err = os.Create(*FlagProbsOut)
+		if err != nil {
+			fatal(err)
+		}
+		writer = bufio.NewWriter(probs)
+		recorder.Steps = json.NewEncoder(writer)
+	}
+	if *FlagTrace != "" {
+		var err error
+		traces, err = os.Create(*FlagTrace)
+		if err != nil {
+			fatal(err)
+		}
+		tracer = bufio.NewWriter(traces)
+		recorder.Traces = json.NewEncoder(tracer)
+	}
+	streamed := *FlagFlushEvery > 0
+	if streamed {
+		Stdout.Write(prompt)
+		Stream = &Streamer{Writer: Stdout, Every: *FlagFlushEvery}
+	}
+	str := GenerateBest(autos, pruned, &files[0].Model, prompt, *FlagN, *FlagBestOf, recorder, rng)
+	Stream = nil
+	if probs != nil {
+		if err := writer.Flush(); err != nil {
+			fatal(err)
+		}
+		if err := probs.Close(); err != nil {
+			fatal(err)
+		}
+	}
+	if traces != nil {
+		if err := tracer.Flush(); err != nil {
+			fatal(err)
+		}
+		if err := traces.Close(); err != nil {
+			fatal(err)
+		}
+	}
+	output(str, len(prompt), streamed)
+	coverage(files, str[len(prompt):])
+}
+
+// coverage prints the kl divergence of the generated byte distribution from the training byte distribution if enabled,
+// a large divergence flags generation that collapsed onto a few bytes
+func coverage(files []File, generated []byte) {
+	if !*FlagCoverage {
+		return
+	}
+	data, _ := split(files)
+	fmt.Fprintf(Stdout, "coverage: kl=%f bits over %d generated bytes\n", ByteKL(generated, data), len(generated))
+}
+
+// generateBatch generates from each prompt of the prompts file, the model is shared by all of the prompts and the
+// context starts over for each prompt. Each generation is written as the quoted prompt and the quoted continuation
+// separated by a tab, so that bytes of the generation can't be confused with the delimiters.
+func generateBatch(generate func(prompt []byte) []byte) {
+	prompts, err := os.Open(*FlagPromptsFile)
+	if err != nil {
+		fatal(err)
+	}
+	defer prompts.Close()
+	out, writer := os.Stdout, Stdout
+	if *FlagOut != "" {
+		out, err = os.Create(*FlagOut)
+		if err != nil {
+			fatal(err)
+		}
+		writer = bufio.NewWriter(out)
+	}
+	scanner := bufio.NewScanner(prompts)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		prompt := Ingest(append([]byte{}, line...))
+		str := generate(prompt)
+		fmt.Fprintf(writer, "%s\t%s\n", strconv.Quote(string(prompt)), strconv.Quote(string(str[len(prompt):])))
+	}
+	if err := scanner.Err(); err != nil {
+		fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		fatal(err)
+	}
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// bitsPerByte prints the bits per byte of the auto encoders and of the markov model over the validation slice
+// if enabled, the context continues from the training window
+func bitsPerByte(autos []Auto, files []File) {
+	if !*FlagBPB {
+		return
+	}
+	data, validation := split(files)
+	model := &files[0].Model
+	contexts := [2]Context{NewContext(), NewContext()}
+	for _, value := range data {
+		contexts[0].Observe(value)
+		contexts[1].Observe(value)
+	}
+	auto := BitsPerByte(func(context *Context) []float64 {
+		return Predict(autos, context, model)
+	}, &contexts[0], validation)
+	markov := BitsPerByte(func(context *Context) []float64 {
+		return PredictMarkov(context, model)
+	}, &contexts[1], validation)
+	fmt.Fprintf(Stdout, "bits per byte: auto %f markov %f\n", auto, markov)
+}
+
+// orderAblation prints a table of the perplexity of the markov model over the validation slice with the lookups
+// restricted to each single order, and the perplexity and loss of the auto encoders if there are any, if enabled,
+// the first row backs off as usual and is the reference
+func orderAblation(autos []Auto, files []File) {
+	if !*FlagOrderAblation {
+		return
+	}
+	_, validation := split(files)
+	model := &files[0].Model
+	if autos == nil {
+		fmt.Fprintf(Stdout, "%-8s %12s\n", "lookup", "markov ppl")
+	} else {
+		fmt.Fprintf(Stdout, "%-8s %12s %12s %12s\n", "lookup", "markov ppl", "auto ppl", "auto loss")
+	}
+	for i := -1; i < order; i++ {
+		context := NewContext()
+		name := "backoff"
+		if i >= 0 {
+			name = fmt.Sprintf("order %d", i)
+			context.Lookup = func(markov *[order]Markov, model *Model) []float32 {
+				return LookupOrder(markov, model, i)
+			}
+		}
+		markov := math.Exp2(BitsPerByte(func(context *Context) []float64 {
+			return PredictMarkov(context, model)
+		}, &context, validation))
+		if autos == nil {
+			fmt.Fprintf(Stdout, "%-8s %12.4f\n", name, markov)
+			continue
+		}
+		context.Reset()
+		auto := math.Exp2(BitsPerByte(func(context *Context) []float64 {
+			return Predict(autos, context, model)
+		}, &context, validation))
+		context.Reset()
+		fmt.Fprintf(Stdout, "%-8s %12.4f %12.4f %12.6f\n", name, markov, auto, EvaluateContext(autos, model, &context, validation))
+	}
+}
+
+// perBook prints a table of the perplexity of each book if enabled
+func perBook(autos []Auto, files []File) {
+	if !*FlagPerBook {
+		return
+	}
+	perplexities := EvaluatePerBook(autos, files)
+	names := make([]string, 0, len(perplexities))
+	for name := range perplexities {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return perplexities[names[i]] < perplexities[names[j]]
+	})
+	fmt.Fprintf(Stdout, "%-20s %s\n", "book", "perplexity")
+	for _, name := range names {
+		fmt.Fprintf(Stdout, "%-20s %f\n", name, perplexities[name])
+	}
+}
+
+// runTrain trains the auto encoders and saves them
+func runTrain(set *flag.FlagSet) {
+	files := loadBooks()
+	if *FlagDryRun {
+		dryRun(set, files)
+		return
+	}
+	if *FlagGrid != "" {
+		grid(set, files)
+		return
+	}
+	rng := rand.New(rand.NewSource(1))
+	autos := train(files, rng)
+	memStats("training")
+	save(autos)
+	dumpWeights(autos)
+	perBook(autos, files)
+	bitsPerByte(autos, files)
+	orderAblation(autos, files)
+}
+
+// runGenerate generates from saved auto encoders or a baseline
+func runGenerate(set *flag.FlagSet) {
+	files := loadBooks()
+	prompt := readPrompt(set, files)
+	rng := rand.New(rand.NewSource(1))
+	if baseline(files, prompt, rng) {
+		return
+	}
+	if !loading() {
+		fatal(errors.New("generate needs saved auto encoders from load or importjson, or a baseline"))
+	}
+	generate(load(), files, prompt, rng)
+}
+
+// runEval evaluates saved auto encoders on the held out validation slice
+func runEval(set *flag.FlagSet) {
+	if !loading() {
+		fatal(errors.New("eval needs saved auto encoders from load or importjson"))
+	}
+	files := loadBooks()
+	autos := load()
+	_, validation := split(files)
+	fmt.Fprintln(Stdout, "validation loss", Evaluate(autos, &files[0].Model, validation))
+	bitsPerByte(autos, files)
+	orderAblation(autos, files)
+
+	report := ConfusionReport(autos, &files[0].Model, validation)
+	symbols := make([]byte, 0, len(report))
+	for symbol := range report {
+		symbols = append(symbols, symbol)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if report[symbols[i]] == report[symbols[j]] {
+			return symbols[i] < symbols[j]
+		}
+		return report[symbols[i]] < report[symbols[j]]
+	})
+	if len(symbols) > *FlagTop {
+		symbols = symbols[:*FlagTop]
+	}
+	fmt.Fprintln(Stdout, "worst predicted symbols")
+	for _, symbol := range symbols {
+		fmt.Fprintf(Stdout, "%-6s %f\n", Symbol(symbol), report[symbol])
+	}
+}
+
+// runInspect prints the most probable continuations of a context
+func runInspect(set *flag.FlagSet) {
+	files := loadBooks()
+	if *FlagStats {
+		modelStats(files)
+		return
+	}
+	if *FlagOrderAblation {
+		orderAblation(nil, files)
+		return
+	}
+	Inspect(Ingest([]byte(*FlagInspect)), &files[0].Model, *FlagTop)
+}
+
+// modelStats prints a table of the statistics of each order of the markov model of each book
+func modelStats(files []File) {
+	for _, file := range files {
+		fmt.Fprintln(Stdout, file.Name)
+		fmt.Fprintf(Stdout, "  %-5s %10s %8s %8s %12s\n", "order", "contexts", "fanout", "entropy", "conditional")
+		for i, stats := range ModelStats(&file.Model) {
+			fmt.Fprintf(Stdout, "  %-5d %10d %8.2f %8.4f %12.4f\n", i, stats.Contexts, stats.FanOut, stats.Entropy, stats.Conditional)
+		}
+	}
+}
+
+// runDiff prints the statistics of the difference between each layer of two saved auto encoders, averaged over the
+// auto encoders, the max difference is the max over the auto encoders
+func runDiff(set *flag.FlagSet) {
+	if set.NArg() != 2 {
+		fatal(errors.New("diff needs two checkpoints"))
+	}
+	var autos [2][]Auto
+	for i := range autos {
+		a, err := LoadAutos(set.Arg(i))
+		if err != nil {
+			fatal(err)
+		}
+		autos[i] = a
+	}
+	diffs, err := DiffAutos(autos[0], autos[1])
+	if err != nil {
+		fatal(err)
+	}
+	var layers []string
+	summary := make(map[string]*LayerDiff)
+	counts := make(map[string]int)
+	for _, diff := range diffs {
+		total := summary[diff.Layer]
+		if total == nil {
+			total = &LayerDiff{Layer: diff.Layer}
+			summary[diff.Layer] = total
+			layers = append(layers, diff.Layer)
+		}
+		total.MeanAbs += diff.MeanAbs
+		total.Max = math.Max(total.Max, diff.Max)
+		total.Cosine += diff.Cosine
+		counts[diff.Layer]++
+	}
+	fmt.Fprintf(Stdout, "%-8s %12s %12s %12s\n", "layer", "mean abs", "max", "cosine")
+	for _, layer := range layers {
+		total, count := summary[layer], float64(counts[layer])
+		fmt.Fprintf(Stdout, "%-8s %12.6f %12.6f %12.6f\n", layer, total.MeanAbs/count, total.Max, total.Cosine/count)
+	}
+}
+
+// runDefault trains or loads the auto encoders and then generates
+func runDefault(set *flag.FlagSet) {
+	if *FlagSelfTest {
+		if err := SelfTest(); err != nil {
+			fatal(err)
+		}
+		fmt.Fprintln(Stdout, "self test passed")
+		return
+	}
+	files := loadBooks()
+	if *FlagStats {
+		modelStats(files)
+		return
+	}
+	if *FlagInspect != "" {
+		Inspect(Ingest([]byte(*FlagInspect)), &files[0].Model, *FlagTop)
+		return
+	}
+
+	if *FlagDryRun {
+		dryRun(set, files)
+		return
+	}
+	if *FlagGrid != "" {
+		grid(set, files)
+		return
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	prompt := readPrompt(set, files)
+	if baseline(files, prompt, rng) {
+		return
+	}
+
+	var autos []Auto
+	if loading() {
+		autos = load()
+	} else {
+		autos = train(files, rng)
+		memStats("training")
+		perBook(autos, files)
+	}
+	bitsPerByte(autos, files)
+	orderAblation(autos, files)
+	save(autos)
+	dumpWeights(autos)
+	generate(autos, files, prompt, rng)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+		for _, command := range Commands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-10s %s\n", command.Name, command.Usage)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nWithout a command the auto encoders are trained and then generate text.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+
+	if len(os.Args) > 1 {
+		for _, command := range Commands {
+			if os.Args[1] != command.Name {
+				continue
 			}
+			set := command.FlagSet()
+			set.Parse(os.Args[2:])
+			configure(set)
+			command.Run(set)
+			flush()
+			return
 		}
 	}
-	fmt.Println(string(str))
+
+	flag.Parse()
+	configure(flag.CommandLine)
+	runDefault(flag.CommandLine)
+	flush()
+}
+
+// flush flushes stdout or exits
+func flush() {
+	if err := Stdout.Flush(); err != nil {
+		fatal(err)
+	}
 }
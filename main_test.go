@@ -0,0 +1,1202 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pointlander/gradient/tf64"
+)
+
+// restoreFlag restores the value of a flag at the end of the test
+func restoreFlag(t testing.TB, name string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("unknown flag %q", name)
+	}
+	value := f.Value.String()
+	t.Cleanup(func() {
+		f.Value.Set(value)
+	})
+}
+
+// setFlag sets a flag for the duration of the test
+func setFlag(t testing.TB, name, value string) {
+	t.Helper()
+	restoreFlag(t, name)
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testFeatures are the markov features of a context that is followed by the symbols of the pattern
+func testFeatures() []float64 {
+	counts := make([]uint32, 256)
+	for i, symbol := range []byte(SelfTestPattern) {
+		counts[symbol] = uint32(i + 1)
+	}
+	var features []float64
+	for _, value := range Normalize(counts) {
+		features = append(features, float64(value))
+	}
+	return features
+}
+
+// lossOf is the loss of the auto encoder for the features
+func lossOf(a *Auto, features []float64, training bool, rng *rand.Rand) float64 {
+	others := Inputs(features)
+	loss := 0.0
+	a.Loss(&others, training, rng)(func(v *tf64.V) bool {
+		loss = v.X[0]
+		return true
+	})
+	return loss
+}
+
+func TestDropout(t *testing.T) {
+	tests := []struct {
+		dropout  string
+		training bool
+		same     bool
+	}{
+		{dropout: "0", training: true, same: true},
+		{dropout: "0", training: false, same: true},
+		{dropout: "0.5", training: false, same: true},
+		{dropout: "0.5", training: true, same: false},
+	}
+	features := testFeatures()
+	for _, test := range tests {
+		rng := rand.New(rand.NewSource(1))
+		a := NewAuto(rng)
+		want := lossOf(&a, features, false, nil)
+		setFlag(t, "dropout", test.dropout)
+		got := lossOf(&a, features, test.training, rng)
+		if (got == want) != test.same {
+			t.Errorf("dropout %s training %t: the loss is %g, without dropout it is %g", test.dropout, test.training, got, want)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	frozen, err := ParseRanges("48-52")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := Frozen
+	Frozen = frozen
+	t.Cleanup(func() {
+		Frozen = saved
+	})
+	setFlag(t, "hidden", "8")
+	rng := rand.New(rand.NewSource(1))
+	data := Synthetic(SelfTestPattern, 256)
+	model := NewModel(data)
+	autos := NewAutos(Symbols(), rng)
+	initial := make([][][]float64, len(autos))
+	for i := range autos {
+		for _, w := range autos[i].Set.Weights {
+			initial[i] = append(initial[i], slices.Clone(w.X))
+		}
+	}
+	if err := Train(autos, &model, data, nil, rng); err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []byte(SelfTestPattern) {
+		a := &autos[symbol]
+		unchanged := true
+		for i, w := range a.Set.Weights {
+			unchanged = unchanged && slices.Equal(w.X, initial[symbol][i])
+		}
+		if unchanged != Frozen[symbol] {
+			t.Errorf("the weights of the auto encoder of %s are unchanged %t, frozen %t", Symbol(symbol), unchanged, Frozen[symbol])
+		}
+	}
+}
+
+// warmStartMargin is how many times smaller than the loss of a random initialization the loss of a warm start must be
+const warmStartMargin = 100
+
+func TestWarmStart(t *testing.T) {
+	features := testFeatures()
+	for _, activation := range []string{"everett", "relu", "tanh"} {
+		setFlag(t, "activation", activation)
+		for seed := range int64(3) {
+			rng := rand.New(rand.NewSource(seed))
+			random, warm := NewAuto(rng), NewAuto(rng)
+			warm.Identity(WarmStartNoise)
+			if r, w := lossOf(&random, features, false, nil), lossOf(&warm, features, false, nil); w >= r/warmStartMargin {
+				t.Errorf("%s seed %d: the warm start loss is %g, expected %d times less than the random loss %g",
+					activation, seed, w, warmStartMargin, r)
+			}
+		}
+	}
+}
+
+func TestLossesToDistribution(t *testing.T) {
+	tests := []struct {
+		name   string
+		losses []float64
+	}{
+		{name: "distinct", losses: []float64{0.5, 0.1, 0.9, 0.3}},
+		{name: "ties", losses: []float64{0.2, 0.2, 0.7, 0.4}},
+		{name: "equal", losses: []float64{0.3, 0.3, 0.3}},
+		{name: "single", losses: []float64{1}},
+		{name: "zero", losses: []float64{0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			distribution := lossesToDistribution(test.losses)
+			sum := 0.0
+			for _, probability := range distribution {
+				sum += probability
+			}
+			if math.Abs(sum-1) > 1e-12 {
+				t.Errorf("the distribution sums to %g", sum)
+			}
+			lowest := slices.Index(test.losses, slices.Min(test.losses))
+			for i, probability := range distribution {
+				if test.losses[i] > test.losses[lowest] && probability >= distribution[lowest] {
+					t.Errorf("loss %g has probability %g, at least that of the lowest loss %g with %g",
+						test.losses[i], probability, test.losses[lowest], distribution[lowest])
+				}
+				if test.losses[i] == test.losses[lowest] && probability != distribution[lowest] {
+					t.Errorf("the lowest losses have probabilities %g and %g", probability, distribution[lowest])
+				}
+			}
+		})
+	}
+}
+
+func TestHiddenWidths(t *testing.T) {
+	tests := []struct {
+		activation string
+		doubles    bool
+	}{
+		{activation: "everett", doubles: true},
+		{activation: "relu", doubles: false},
+		{activation: "tanh", doubles: false},
+	}
+	features := testFeatures()
+	for _, test := range tests {
+		for _, hidden := range []int{1, 7, 64, 300} {
+			setFlag(t, "activation", test.activation)
+			setFlag(t, "hidden", strconv.Itoa(hidden))
+			a := NewAuto(rand.New(rand.NewSource(1)))
+			width := hidden
+			if test.doubles {
+				width *= 2
+			}
+			if l2 := a.Set.ByName["l2"]; l2.S[0] != width {
+				t.Errorf("%s hidden %d: l2 has %d inputs, want %d", test.activation, hidden, l2.S[0], width)
+			}
+			if loss := lossOf(&a, features, false, nil); math.IsNaN(loss) || math.IsInf(loss, 0) || loss <= 0 {
+				t.Errorf("%s hidden %d: the loss is %g", test.activation, hidden, loss)
+			}
+		}
+	}
+}
+
+func TestOnline(t *testing.T) {
+	setFlag(t, "hidden", "8")
+	data := Synthetic(SelfTestPattern, 512)
+	tests := []struct {
+		name  string
+		split int
+	}{
+		{name: "empty model", split: 0},
+		{name: "built model", split: 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			var model Model
+			model.Ingest(data[:test.split])
+			online := NewOnline(NewAutos(Symbols(), rng), &model, rng)
+			for _, value := range data[test.split:] {
+				if loss := online.Observe(value); math.IsNaN(loss) || math.IsInf(loss, 0) || loss <= 0 {
+					t.Fatalf("the loss of %s is %g", Symbol(value), loss)
+				}
+				online.UpdateModel(value)
+			}
+			whole := NewModel(data)
+			var got, want bytes.Buffer
+			if err := WriteModel(&got, &model); err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteModel(&want, &whole); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Error("the online markov model differs from the markov model of the data")
+			}
+			if online.Context.Markov != whole.Markov {
+				t.Errorf("the context is %v, the markov model is at %v", online.Context.Markov, whole.Markov)
+			}
+			for _, symbol := range []byte(SelfTestPattern) {
+				if want := bytes.Count(data[test.split:], []byte{symbol}); online.Autos[symbol].Iteration != want {
+					t.Errorf("the auto encoder of %s was updated %d times, want %d", Symbol(symbol), online.Autos[symbol].Iteration, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSmooth(t *testing.T) {
+	target := testFeatures()
+	tests := []struct {
+		eps       float64
+		unchanged bool
+	}{
+		{eps: 0, unchanged: true},
+		{eps: 0.1},
+		{eps: 1},
+	}
+	for _, test := range tests {
+		smoothed := Smooth(target, test.eps)
+		sum := 0.0
+		for _, value := range smoothed {
+			sum += value
+		}
+		// the target is normalized in float32
+		if math.Abs(sum-1) > 1e-6 {
+			t.Errorf("eps %g: the smoothed target sums to %g", test.eps, sum)
+		}
+		if equal := slices.Equal(smoothed, target); equal != test.unchanged {
+			t.Errorf("eps %g: the smoothed target is unchanged %t, want %t", test.eps, equal, test.unchanged)
+		}
+		if test.eps == 1 && slices.ContainsFunc(smoothed, func(value float64) bool { return value != 1.0/256 }) {
+			t.Errorf("eps 1: the smoothed target isn't uniform")
+		}
+	}
+}
+
+func TestSubsample(t *testing.T) {
+	setFlag(t, "hidden", "8")
+	data := Synthetic(SelfTestPattern, 512)
+	model := NewModel(data)
+
+	// a full pass trains every example in order
+	rng := rand.New(rand.NewSource(1))
+	full := NewAutos(Symbols(), rng)
+	context := NewContext()
+	context.Observe(0)
+	for _, value := range data {
+		others := Inputs(context.Features(&model))
+		full[value].Update(&others, rng)
+		context.Observe(value)
+	}
+
+	tests := []struct {
+		subsample string
+		same      bool
+	}{
+		{subsample: "1", same: true},
+		{subsample: "0.5", same: false},
+	}
+	for _, test := range tests {
+		setFlag(t, "subsample", test.subsample)
+		rng := rand.New(rand.NewSource(1))
+		autos := NewAutos(Symbols(), rng)
+		if err := Train(autos, &model, data, nil, rng); err != nil {
+			t.Fatal(err)
+		}
+		iterations, same := 0, true
+		for i := range autos {
+			iterations += autos[i].Iteration
+			for ii, w := range autos[i].Set.Weights {
+				same = same && slices.Equal(w.X, full[i].Set.Weights[ii].X)
+			}
+		}
+		if same != test.same {
+			t.Errorf("subsample %s: the weights are the same as a full pass %t, want %t", test.subsample, same, test.same)
+		}
+		if fraction, _ := strconv.ParseFloat(test.subsample, 64); math.Abs(float64(iterations)/float64(len(data))-fraction) > 0.1 {
+			t.Errorf("subsample %s: %d of %d examples were trained on", test.subsample, iterations, len(data))
+		}
+	}
+}
+
+func TestEMA(t *testing.T) {
+	features := testFeatures()
+	// a decay of 0 averages nothing, so the average is the raw weights
+	for _, decay := range []float64{0, 0.5, 0.9, 0.99} {
+		setFlag(t, "ema", strconv.FormatFloat(decay, 'g', -1, 64))
+		rng := rand.New(rand.NewSource(1))
+		a := NewAuto(rng)
+		a.EnableEMA()
+		average := make([][]float64, len(a.Set.Weights))
+		for i, w := range a.Set.Weights {
+			average[i] = slices.Clone(w.X)
+		}
+		for range 100 {
+			others := Inputs(features)
+			a.Update(&others, rng)
+			for i, w := range a.Set.Weights {
+				for ii, value := range w.X {
+					average[i][ii] = decay*average[i][ii] + (1-decay)*value
+				}
+			}
+		}
+		a.SwapEMA()
+		for i, w := range a.Set.Weights {
+			for ii, value := range w.X {
+				if math.Abs(value-average[i][ii]) > 1e-12 {
+					t.Fatalf("decay %g: %s[%d] is %g, the average of the weights is %g", decay, w.N, ii, value, average[i][ii])
+				}
+			}
+		}
+	}
+
+	// without the flag the average isn't enabled and swapping keeps the raw weights
+	setFlag(t, "ema", "0")
+	var weights [2][][]float64
+	for i := range weights {
+		rng := rand.New(rand.NewSource(1))
+		a := NewAuto(rng)
+		for range 100 {
+			others := Inputs(features)
+			a.Update(&others, rng)
+		}
+		if i == 1 {
+			a.SwapEMA()
+		}
+		for _, w := range a.Set.Weights {
+			if len(w.States) > StateEMA {
+				t.Fatalf("%s has the state of the average", w.N)
+			}
+			weights[i] = append(weights[i], w.X)
+		}
+	}
+	for i := range weights[0] {
+		if !slices.Equal(weights[0][i], weights[1][i]) {
+			t.Errorf("weight %d changed without the average", i)
+		}
+	}
+}
+
+func TestSnapshotRestoresEMA(t *testing.T) {
+	setFlag(t, "ema", "0.9")
+	features := testFeatures()
+	rng := rand.New(rand.NewSource(1))
+	autos := []Auto{NewAuto(rng)}
+	autos[0].EnableEMA()
+	update := func() {
+		others := Inputs(features)
+		autos[0].Update(&others, rng)
+	}
+	update()
+	snapshot := NewSnapshot(autos)
+	var weights, averages [][]float64
+	for _, w := range autos[0].Set.Weights {
+		weights = append(weights, slices.Clone(w.X))
+		averages = append(averages, slices.Clone(w.States[StateEMA]))
+	}
+	for range 10 {
+		update()
+	}
+	snapshot.Restore(autos)
+	for i, w := range autos[0].Set.Weights {
+		if !slices.Equal(w.X, weights[i]) {
+			t.Errorf("%s wasn't restored", w.N)
+		}
+		if !slices.Equal(w.States[StateEMA], averages[i]) {
+			t.Errorf("the average of %s wasn't restored", w.N)
+		}
+	}
+}
+
+func TestIngestIncremental(t *testing.T) {
+	data := Synthetic(SelfTestPattern+"\n", SelfTestBytes)
+	tests := []struct {
+		name  string
+		split int
+	}{
+		{name: "empty first", split: 0},
+		{name: "one byte first", split: 1},
+		{name: "order bytes first", split: order},
+		{name: "halves", split: len(data) / 2},
+		{name: "empty second", split: len(data)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var whole, parts Model
+			whole.Ingest(data)
+			parts.Ingest(data[:test.split])
+			parts.Ingest(data[test.split:])
+			var serialized [2]bytes.Buffer
+			for i, model := range []*Model{&whole, &parts} {
+				if err := WriteModel(&serialized[i], model); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(serialized[0].Bytes(), serialized[1].Bytes()) {
+				t.Error("the counts of the model ingested in two parts differ from the model ingested at once")
+			}
+			if whole.Markov != parts.Markov {
+				t.Errorf("the context at the end is %v, want %v", parts.Markov, whole.Markov)
+			}
+		})
+	}
+}
+
+func TestResetBoundary(t *testing.T) {
+	for _, reset := range []byte{'|', '\n', 0} {
+		t.Run(strconv.Quote(string(reset)), func(t *testing.T) {
+			saved := Resets
+			defer func() { Resets = saved }()
+			Resets[reset] = true
+			segments := []string{"abcab", "xyzxy", "abc"}
+			data := []byte(segments[0] + string(reset) + segments[1] + string(reset) + segments[2])
+
+			// the contexts of the model are the recent bytes of a single segment
+			model := NewModel(data)
+			for i := range model.Counts {
+				for markov := range model.Counts[i] {
+					var recent []byte
+					for _, value := range markov[:i+1] {
+						if value == 0 {
+							break
+						}
+						recent = append([]byte{value}, recent...)
+					}
+					if !slices.ContainsFunc(segments, func(segment string) bool {
+						return strings.Contains(segment, string(recent))
+					}) {
+						t.Errorf("order %d has the context %q that spans a reset", i, recent)
+					}
+				}
+			}
+
+			// the walk of training starts over after each reset
+			context := NewContext()
+			start := 0
+			for i, value := range data {
+				context.Observe(value)
+				if value == reset {
+					start = i + 1
+				}
+				fresh := NewContext()
+				for _, value := range data[start : i+1] {
+					fresh.Observe(value)
+				}
+				if context.Markov != fresh.Markov {
+					t.Fatalf("the context after %q is %v, want the context of %q", data[:i+1], context.Markov, data[start:i+1])
+				}
+			}
+		})
+	}
+}
+
+func TestLookupHighestOrder(t *testing.T) {
+	// the lower orders of the contexts are followed by both digits, the higher orders by one of them
+	model := NewModel([]byte("xab1 yab2 xab1 yab2"))
+	tests := []struct {
+		context string
+		highest int
+		next    byte
+	}{
+		{context: "zxab", highest: 2, next: '1'},
+		{context: "zyab", highest: 2, next: '2'},
+		{context: " xab", highest: 3, next: '1'},
+		{context: " yab", highest: 3, next: '2'},
+	}
+	for _, test := range tests {
+		var markov [order]Markov
+		for _, value := range []byte(test.context) {
+			Iterate(&markov, value)
+		}
+		for i := range order {
+			if counts := model.Counts[i][markov[i]]; (counts != nil) != (i <= test.highest) {
+				t.Fatalf("context %q: order %d has counts %v", test.context, i, counts)
+			}
+		}
+		vector := Lookup(&markov, &model)
+		if want := Normalize(model.Counts[test.highest][markov[test.highest]]); !slices.Equal(vector, want) {
+			t.Errorf("context %q: the lookup isn't the vector of order %d", test.context, test.highest)
+		}
+		if vector[test.next] != 1 {
+			t.Errorf("context %q: %q has probability %g, want 1", test.context, test.next, vector[test.next])
+		}
+		if lower := Normalize(model.Counts[0][markov[0]]); lower[test.next] == 1 {
+			t.Errorf("context %q: order 0 doesn't tell the digits apart", test.context)
+		}
+	}
+}
+
+func TestLookupUniform(t *testing.T) {
+	var empty Model
+	empty.Ingest(nil)
+	model := NewModel([]byte("abcabc"))
+	tests := []struct {
+		name    string
+		model   *Model
+		context string
+		uniform bool
+	}{
+		{name: "empty model", model: &empty, context: "abc", uniform: true},
+		{name: "empty model and context", model: &empty, context: "", uniform: true},
+		{name: "unseen context", model: &model, context: "xyz", uniform: true},
+		{name: "seen context", model: &model, context: "ab", uniform: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var markov [order]Markov
+			for _, value := range []byte(test.context) {
+				Iterate(&markov, value)
+			}
+			vector := Lookup(&markov, test.model)
+			if vector == nil {
+				t.Fatal("lookup returned nil")
+			}
+			if uniform := slices.Equal(vector, Uniform()); uniform != test.uniform {
+				t.Errorf("the vector is uniform %t, want %t", uniform, test.uniform)
+			}
+		})
+	}
+}
+
+func TestLookupOrder(t *testing.T) {
+	model := NewModel([]byte("abcabc"))
+	tests := []struct {
+		context string
+		order   int
+		uniform bool
+	}{
+		{context: "xab", order: 0, uniform: false},
+		{context: "xab", order: 1, uniform: false},
+		{context: "xab", order: 2, uniform: true},
+		{context: "cab", order: 2, uniform: false},
+		{context: "xyz", order: 0, uniform: true},
+	}
+	for _, test := range tests {
+		context := NewContext()
+		context.Lookup = func(markov *[order]Markov, model *Model) []float32 {
+			return LookupOrder(markov, model, test.order)
+		}
+		for _, value := range []byte(test.context) {
+			context.Observe(value)
+		}
+		vector := context.Condition(&model)
+		if uniform := slices.Equal(vector, Uniform()); uniform != test.uniform {
+			t.Errorf("context %q order %d: the vector is uniform %t, want %t", test.context, test.order, uniform, test.uniform)
+		}
+		if counts := model.Counts[test.order][context.Markov[test.order]]; counts != nil && !slices.Equal(vector, Normalize(counts)) {
+			t.Errorf("context %q order %d: %v isn't the counts of the order", test.context, test.order, Top(vector, 3))
+		}
+	}
+
+	// the lookup of a context doesn't change the lookups of other contexts
+	backoff := NewContext()
+	for _, value := range []byte("xab") {
+		backoff.Observe(value)
+	}
+	if vector := backoff.Condition(&model); !slices.Equal(vector, Lookup(&backoff.Markov, &model)) {
+		t.Errorf("a context without a lookup doesn't back off")
+	}
+}
+
+func TestDenoise(t *testing.T) {
+	tests := []struct {
+		denoise string
+		same    bool
+	}{
+		{denoise: "0", same: true},
+		{denoise: "0.1", same: false},
+	}
+	for _, test := range tests {
+		setFlag(t, "denoise", test.denoise)
+		rng := rand.New(rand.NewSource(1))
+		a := NewAuto(rng)
+		others := Inputs(testFeatures())
+		a.Update(&others, rng)
+		in, out := others.ByName["input"].X, others.ByName["output"].X
+		if same := slices.Equal(in, out); same != test.same {
+			t.Errorf("denoise %s: the input is the same as the target %t, want %t", test.denoise, same, test.same)
+		}
+		if !slices.Equal(out, testFeatures()) {
+			t.Errorf("denoise %s: the target was changed", test.denoise)
+		}
+	}
+}
+
+func TestBalancedRate(t *testing.T) {
+	tests := []struct {
+		observed, total, autos int
+		want                   float64
+	}{
+		{observed: 100, total: 25600, autos: 256, want: 1},
+		{observed: 25, total: 25600, autos: 256, want: 2},
+		{observed: 400, total: 25600, autos: 256, want: 0.5},
+		{observed: 1, total: 25600, autos: 256, want: BalanceLimit},
+		{observed: 25600, total: 25600, autos: 256, want: 1 / BalanceLimit},
+		{observed: 0, total: 256, autos: 256, want: 1},
+	}
+	for _, test := range tests {
+		if got := BalancedRate(test.observed, test.total, test.autos); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("BalancedRate(%d, %d, %d) = %g, want %g", test.observed, test.total, test.autos, got, test.want)
+		}
+	}
+}
+
+func TestBalanceLRMovesRareAuto(t *testing.T) {
+	setFlag(t, "hidden", "8")
+	data := Synthetic(SelfTestPattern, 2048)
+	data[1500] = 'x'
+	model := NewModel(data)
+	moved := make(map[bool]float64)
+	for _, balance := range []bool{false, true} {
+		setFlag(t, "balancelr", strconv.FormatBool(balance))
+		rng := rand.New(rand.NewSource(1))
+		autos := NewAutos(Symbols(), rng)
+		var initial [][]float64
+		for _, w := range autos['x'].Set.Weights {
+			initial = append(initial, slices.Clone(w.X))
+		}
+		if err := Train(autos, &model, data, nil, rng); err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range autos['x'].Set.Weights {
+			for ii, value := range w.X {
+				moved[balance] += (value - initial[i][ii]) * (value - initial[i][ii])
+			}
+		}
+	}
+	if moved[true] == 0 || moved[true] <= moved[false] {
+		t.Errorf("the rare auto encoder moved %g with balancelr and %g without", moved[true], moved[false])
+	}
+}
+
+func TestBitsPerByte(t *testing.T) {
+	setFlag(t, "hidden", "8")
+	data := Synthetic(SelfTestPattern, 256)
+	model := NewModel(data)
+	primed := func(prefix []byte) *Context {
+		context := NewContext()
+		for _, value := range prefix {
+			context.Observe(value)
+		}
+		return &context
+	}
+	uniform := func(context *Context) []float64 {
+		return PredictMarkov(primed(nil), &Model{})
+	}
+	markov := func(context *Context) []float64 {
+		return PredictMarkov(context, &model)
+	}
+	if bits := BitsPerByte(uniform, primed(nil), data); math.Abs(bits-8) > 1e-9 {
+		t.Errorf("the uniform distribution takes %g bits per byte, want 8", bits)
+	}
+	if bits := BitsPerByte(markov, primed(data[:100]), data[100:]); bits > 1e-9 {
+		t.Errorf("the markov model of a repeating pattern takes %g bits per byte, want 0", bits)
+	}
+
+	// the auto encoders see the same features as they do for the perplexity
+	tests := []struct {
+		features string
+		pos      string
+	}{
+		{features: "markov", pos: "false"},
+		{features: "histogram", pos: "false"},
+		{features: "markov", pos: "true"},
+	}
+	for _, test := range tests {
+		setFlag(t, "features", test.features)
+		setFlag(t, "pos", test.pos)
+		setFlag(t, "mix", "0.5")
+		autos := NewAutos([]byte(SelfTestPattern), rand.New(rand.NewSource(1)))
+		bits := BitsPerByte(func(context *Context) []float64 {
+			return Predict(autos, context, &model)
+		}, primed(data[:100]), data[100:])
+		if perplexity := Perplexity(autos, &model, data[:100], data[100:]); math.Abs(bits-math.Log2(perplexity)) > 1e-9 {
+			t.Errorf("features %s pos %s: %g bits per byte, the perplexity is %g bits", test.features, test.pos, bits, math.Log2(perplexity))
+		}
+	}
+}
+
+func TestInputClip(t *testing.T) {
+	features := testFeatures()
+	tests := []struct {
+		name    string
+		clip    string
+		denoise string
+		lo, hi  float64
+		same    bool
+	}{
+		{name: "disabled", same: true},
+		{name: "passthrough", clip: "0,1", lo: 0, hi: 1, same: true},
+		{name: "clamped", clip: "0.01,0.1", lo: 0.01, hi: 0.1, same: false},
+		{name: "clamped after noise", clip: "0,1", denoise: "0.5", lo: 0, hi: 1, same: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saved := InputClip
+			t.Cleanup(func() {
+				InputClip = saved
+			})
+			InputClip = nil
+			if test.clip != "" {
+				clip, err := ParseRange(test.clip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				InputClip = clip
+			}
+			others := Inputs(features)
+			if test.denoise != "" {
+				setFlag(t, "denoise", test.denoise)
+				rng := rand.New(rand.NewSource(1))
+				a := NewAuto(rng)
+				a.Update(&others, rng)
+			}
+			in := others.ByName["input"].X
+			if same := slices.Equal(in, features); same != test.same {
+				t.Errorf("the input is the same as the features %t, want %t", same, test.same)
+			}
+			if !slices.Equal(others.ByName["output"].X, features) {
+				t.Error("the target was clamped")
+			}
+			if InputClip == nil {
+				return
+			}
+			for i, value := range in {
+				if value < test.lo || value > test.hi {
+					t.Fatalf("input %d is %g, outside of [%g, %g]", i, value, test.lo, test.hi)
+				}
+				if features[i] >= test.lo && features[i] <= test.hi && test.denoise == "" && value != features[i] {
+					t.Fatalf("input %d is %g, the feature %g is within range", i, value, features[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateMarkovSize(t *testing.T) {
+	model := NewModel(Synthetic(SelfTestPattern, 256))
+	prompt := []byte("012")
+	for _, size := range []int{0, 1, 33, 100} {
+		generated := GenerateMarkov(&model, prompt, size, rand.New(rand.NewSource(1)))
+		if len(generated) != len(prompt)+size || !bytes.HasPrefix(generated, prompt) {
+			t.Errorf("size %d: generated %q from %q", size, generated, prompt)
+		}
+		if accuracy := PatternAccuracy(SelfTestPattern, generated); size > 0 && accuracy != 1 {
+			t.Errorf("size %d: %q follows the pattern with accuracy %g", size, generated, accuracy)
+		}
+	}
+}
+
+func TestGenerateBestRecordsWinner(t *testing.T) {
+	setFlag(t, "hidden", "8")
+	model := NewModel(Synthetic(SelfTestPattern, 256))
+	autos := NewAutos([]byte(SelfTestPattern), rand.New(rand.NewSource(1)))
+	prompt := []byte("012")
+	const size = 5
+	for _, n := range []int{1, 3} {
+		var steps, traces bytes.Buffer
+		recorder := Recorder{Steps: json.NewEncoder(&steps), Traces: json.NewEncoder(&traces)}
+		generated := GenerateBest(autos, nil, &model, prompt, size, n, recorder, rand.New(rand.NewSource(1)))
+		var recordedSteps []Step
+		for decoder := json.NewDecoder(&steps); decoder.More(); {
+			var step Step
+			if err := decoder.Decode(&step); err != nil {
+				t.Fatal(err)
+			}
+			recordedSteps = append(recordedSteps, step)
+		}
+		var recordedTraces []Trace
+		for decoder := json.NewDecoder(&traces); decoder.More(); {
+			var trace Trace
+			if err := decoder.Decode(&trace); err != nil {
+				t.Fatal(err)
+			}
+			recordedTraces = append(recordedTraces, trace)
+		}
+		if len(recordedSteps) != size || len(recordedTraces) != size {
+			t.Fatalf("bestof %d: %d steps and %d traces recorded for %d bytes", n, len(recordedSteps), len(recordedTraces), size)
+		}
+		for i, b := range generated[len(prompt):] {
+			step, trace := recordedSteps[i], recordedTraces[i]
+			if step.Step != i || trace.Step != i || step.Byte != b || trace.Byte != b {
+				t.Errorf("bestof %d: step %d records step %d byte %q and trace %d byte %q, generated %q", n, i,
+					step.Step, step.Byte, trace.Step, trace.Byte, b)
+			}
+		}
+	}
+}
+
+func TestGenerateRecordingUnchanged(t *testing.T) {
+	setFlag(t, "hidden", "8")
+	model := NewModel(Synthetic(SelfTestPattern, 256))
+	autos := NewAutos([]byte(SelfTestPattern), rand.New(rand.NewSource(1)))
+	prompt := []byte("012")
+	for _, n := range []int{1, 3} {
+		var steps, traces bytes.Buffer
+		recorders := []Recorder{
+			{},
+			{Steps: json.NewEncoder(&steps)},
+			{Traces: json.NewEncoder(&traces)},
+			{Steps: json.NewEncoder(&steps), Traces: json.NewEncoder(&traces)},
+		}
+		var want []byte
+		for i, recorder := range recorders {
+			generated := GenerateBest(autos, nil, &model, prompt, 32, n, recorder, rand.New(rand.NewSource(1)))
+			if i == 0 {
+				want = generated
+				continue
+			}
+			if !bytes.Equal(generated, want) {
+				t.Errorf("bestof %d: recorder %d generated %q, unrecorded generated %q", n, i, generated, want)
+			}
+		}
+	}
+}
+
+func TestPruneUntrained(t *testing.T) {
+	setFlag(t, "hidden", "8")
+	autos := NewAutos([]byte("abcd"), rand.New(rand.NewSource(1)))
+	autos[0].Iteration, autos[2].Iteration = 1, 5
+	trained, pruned := PruneUntrained(autos)
+	if len(trained) != 2 || trained[0].Symbol != 'a' || trained[1].Symbol != 'c' {
+		t.Fatalf("%d auto encoders were kept", len(trained))
+	}
+	for symbol, ok := range pruned {
+		if want := symbol == 'b' || symbol == 'd'; ok != want {
+			t.Errorf("%q is pruned %t, want %t", symbol, ok, want)
+		}
+	}
+
+	symbols, losses := AutoLosses(trained, testFeatures())
+	tests := []struct {
+		name   string
+		pruned *[256]bool
+		want   float64
+	}{
+		{name: "pruned", pruned: pruned, want: PrunedProbability},
+		{name: "not pruned", pruned: nil, want: 0},
+	}
+	for _, test := range tests {
+		distribution := LossDistribution(symbols, losses, test.pruned)
+		sum := 0.0
+		for _, value := range distribution {
+			sum += value
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("%s: the distribution sums to %g", test.name, sum)
+		}
+		for _, symbol := range []byte("bd") {
+			if distribution[symbol] != test.want {
+				t.Errorf("%s: %q has probability %g, want %g", test.name, symbol, distribution[symbol], test.want)
+			}
+		}
+	}
+}
+
+func TestDenoiseConditioning(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]string
+	}{
+		{name: "pos", flags: map[string]string{"pos": "true"}},
+		{name: "shared", flags: map[string]string{"shared": "true"}},
+		{name: "pos and shared", flags: map[string]string{"pos": "true", "shared": "true"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			setFlag(t, "hidden", "8")
+			setFlag(t, "denoise", "0.5")
+			features := testFeatures()
+			if *FlagPos {
+				features = append(features, Position(7)...)
+			}
+			features = OneHot(features, 'a')
+			rng := rand.New(rand.NewSource(1))
+			a := NewAuto(rng)
+			others := Inputs(features)
+			a.Update(&others, rng)
+			in := others.ByName["input"].X
+			if slices.Equal(in[:256], features[:256]) {
+				t.Error("the markov features weren't corrupted")
+			}
+			if !slices.Equal(in[256:], features[256:]) {
+				t.Error("the conditioning of the input was corrupted")
+			}
+		})
+	}
+}
+
+func TestConfidenceWeight(t *testing.T) {
+	tests := []struct {
+		count uint32
+		want  float64
+	}{
+		{count: 0, want: 1.0 / (1 + ConfidenceHalf)},
+		{count: ConfidenceHalf - 1, want: 0.5},
+		{count: 1 << 20, want: 1},
+	}
+	for _, test := range tests {
+		if got := ConfidenceWeight(test.count); math.Abs(got-test.want) > 1e-4 {
+			t.Errorf("ConfidenceWeight(%d) = %g, want %g", test.count, got, test.want)
+		}
+	}
+
+	// the first adam step moves each weight by about eta times the rate, so the move grows with the count
+	features := testFeatures()
+	previous := 0.0
+	for _, count := range []uint32{0, 1, 15, 100, 10000} {
+		a := NewAuto(rand.New(rand.NewSource(1)))
+		a.Rate = ConfidenceWeight(count)
+		initial := slices.Clone(a.Set.ByName["l1"].X)
+		others := Inputs(features)
+		a.Update(&others, nil)
+		moved := 0.0
+		for i, value := range a.Set.ByName["l1"].X {
+			moved += math.Abs(value - initial[i])
+		}
+		if moved <= previous {
+			t.Errorf("count %d: the update moved l1 by %g, a lower count moved it by %g", count, moved, previous)
+		}
+		previous = moved
+	}
+}
+
+func TestTiedParameters(t *testing.T) {
+	setFlag(t, "activation", "relu")
+	parameters := func(a Auto) int {
+		count := 0
+		for _, w := range a.Set.Weights {
+			count += len(w.X)
+		}
+		return count
+	}
+	for _, hidden := range []int{8, 16, 256} {
+		setFlag(t, "hidden", strconv.Itoa(hidden))
+		setFlag(t, "tied", "false")
+		untied := parameters(NewAuto(rand.New(rand.NewSource(1))))
+		setFlag(t, "tied", "true")
+		tied := NewAuto(rand.New(rand.NewSource(1)))
+		if got, want := parameters(tied), untied-hidden*256; got != want {
+			t.Errorf("hidden %d: %d parameters when tied, %d untied, want %d", hidden, got, untied, want)
+		}
+		if loss := lossOf(&tied, testFeatures(), false, nil); math.IsNaN(loss) || math.IsInf(loss, 0) {
+			t.Errorf("hidden %d: the tied loss is %g", hidden, loss)
+		}
+	}
+}
+
+// baselineTolerance is the largest loss before training that counts as reproducing the markov features
+const baselineTolerance = 1e-12
+
+func TestFromBaseline(t *testing.T) {
+	data := Synthetic(SelfTestPattern, SelfTestBytes)
+	model := NewModel(data)
+	tests := []struct {
+		activation string
+		pos        string
+		shared     string
+	}{
+		{activation: "everett", pos: "false", shared: "false"},
+		{activation: "relu", pos: "false", shared: "false"},
+		{activation: "everett", pos: "true", shared: "false"},
+		{activation: "relu", pos: "true", shared: "false"},
+		{activation: "everett", pos: "false", shared: "true"},
+		{activation: "relu", pos: "false", shared: "true"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s pos %s shared %s", test.activation, test.pos, test.shared), func(t *testing.T) {
+			setFlag(t, "activation", test.activation)
+			setFlag(t, "pos", test.pos)
+			setFlag(t, "shared", test.shared)
+			rng := rand.New(rand.NewSource(1))
+			autos := NewAutos([]byte(SelfTestPattern), rng)
+			for i := range autos {
+				autos[i].Identity(0)
+			}
+			if loss := Evaluate(autos, &model, data[:SelfTestContexts]); loss > baselineTolerance {
+				t.Errorf("the loss before training is %g, expected at most %g", loss, baselineTolerance)
+			}
+		})
+	}
+}
+
+const (
+	// adamSteps is the number of updates of the adam check
+	adamSteps = 2000
+	// adamFactor is how many times smaller than the initial loss the final loss of the adam check must be
+	adamFactor = 10
+)
+
+func TestAdamConverges(t *testing.T) {
+	for _, pos := range []string{"false", "true"} {
+		t.Run("pos "+pos, func(t *testing.T) {
+			setFlag(t, "pos", pos)
+			rng := rand.New(rand.NewSource(1))
+			a := NewAuto(rng)
+			features := testFeatures()
+			if *FlagPos {
+				features = append(features, Position(0)...)
+			}
+			features = OneHot(features, SelfTestPattern[0])
+			initial, loss := 0.0, 0.0
+			for step := range adamSteps {
+				others := Inputs(features)
+				loss = a.Update(&others, rng)
+				if math.IsNaN(loss) || math.IsInf(loss, 0) {
+					t.Fatalf("the loss isn't finite at step %d", step)
+				}
+				if step == 0 {
+					initial = loss
+				}
+			}
+			if loss > initial/adamFactor {
+				t.Errorf("the loss went from %f to %f in %d steps, expected at most %f", initial, loss, adamSteps,
+					initial/adamFactor)
+			}
+		})
+	}
+}
+
+func BenchmarkTrainChunked(b *testing.B) {
+	saved := Stdout
+	Stdout = bufio.NewWriter(io.Discard)
+	b.Cleanup(func() {
+		Stdout = saved
+	})
+	book, err := ReadBook(Books[0], "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	book = book[:64*1024]
+	data, model := book[:1024], NewModel(book)
+	symbols := Vocabulary(data)
+	for _, chunked := range []string{"0", "64", "1024"} {
+		b.Run("chunked="+chunked, func(b *testing.B) {
+			setFlag(b, "chunked", chunked)
+			setFlag(b, "hidden", "64")
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				b.StopTimer()
+				rng := rand.New(rand.NewSource(1))
+				autos := NewAutos(symbols, rng)
+				b.StartTimer()
+				if err := Train(autos, &model, data, nil, rng); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// ReferenceCorpora are hand chosen sequences that the markov model is checked against the reference on: empty,
+// shorter than the highest order, repeats, and zero bytes that look like the padding of a fresh context
+var ReferenceCorpora = []string{"", "a", "abracadabra", SelfTestPattern, "\x00\x00\x01\x00", "aaaaaaaaab aaab"}
+
+// ReferenceContext is the context of each order computed naively from the history since the last reset: the most
+// recent byte first, padded with zeros
+func ReferenceContext(history []byte) [order]Markov {
+	var markov [order]Markov
+	for i := range markov {
+		for j := 0; j <= i && j < len(history); j++ {
+			markov[i][j] = history[len(history)-1-j]
+		}
+	}
+	return markov
+}
+
+// referenceTolerance is the largest difference between a probability of Lookup and of the reference
+const referenceTolerance = 1e-6
+
+// ReferenceLookup checks that Iterate and Lookup agree with a naive reference over data: the context of every
+// step, and the distribution of every step from counts that are kept per order and context and backed off from
+// the highest order
+func ReferenceLookup(data []byte) error {
+	var counts [order]map[Markov][]int
+	for i := range counts {
+		counts[i] = make(map[Markov][]int)
+	}
+	var history []byte
+	for _, value := range data {
+		markov := ReferenceContext(history)
+		for i := range counts {
+			if counts[i][markov[i]] == nil {
+				counts[i][markov[i]] = make([]int, 256)
+			}
+			counts[i][markov[i]][value]++
+		}
+		history = append(history, value)
+		if Resets[value] {
+			history = history[:0]
+		}
+	}
+
+	model := NewModel(data)
+	var markov [order]Markov
+	history = history[:0]
+	for step := 0; step <= len(data); step++ {
+		if reference := ReferenceContext(history); markov != reference {
+			return fmt.Errorf("at step %d of %q the context is %v, the reference is %v",
+				step, data, markov, reference)
+		}
+		reference := Uniform()
+		for i := order - 1; i >= 0; i-- {
+			if vector := counts[i][markov[i]]; vector != nil {
+				sum := 0
+				for _, count := range vector {
+					sum += count
+				}
+				for symbol, count := range vector {
+					reference[symbol] = float32(float64(count) / float64(sum))
+				}
+				break
+			}
+		}
+		for symbol, probability := range Lookup(&markov, &model) {
+			if math.Abs(float64(probability-reference[symbol])) > referenceTolerance {
+				return fmt.Errorf("at step %d of %q lookup gives %s probability %f, the reference gives %f",
+					step, data, Symbol(byte(symbol)), probability, reference[symbol])
+			}
+		}
+		if step == len(data) {
+			break
+		}
+		Iterate(&markov, data[step])
+		history = append(history, data[step])
+		if Resets[data[step]] {
+			history = history[:0]
+		}
+	}
+	return nil
+}
+
+func FuzzIterateLookup(f *testing.F) {
+	for _, corpus := range ReferenceCorpora {
+		f.Add([]byte(corpus), false)
+		f.Add([]byte(corpus), true)
+	}
+	f.Add([]byte("ab\nab \nab"), true)
+	f.Fuzz(func(t *testing.T, data []byte, reset bool) {
+		saved := Resets
+		defer func() {
+			Resets = saved
+		}()
+		Resets['\n'] = reset
+		if err := ReferenceLookup(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+// ModelMagic identifies a markov model file
+const ModelMagic = "MARK"
+
+// WriteModel writes a markov model in a canonical order: the contexts of each order are sorted by their bytes,
+// so that models built from the same data serialize to identical bytes
+func WriteModel(output io.Writer, model *Model) error {
+	var err error
+	write := func(data any) {
+		if err == nil {
+			err = binary.Write(output, binary.LittleEndian, data)
+		}
+	}
+
+	write([]byte(ModelMagic))
+	write(uint32(order))
+	for i := range model.Counts {
+		contexts := make([]Markov, 0, len(model.Counts[i]))
+		for context := range model.Counts[i] {
+			contexts = append(contexts, context)
+		}
+		slices.SortFunc(contexts, func(a, b Markov) int {
+			return bytes.Compare(a[:], b[:])
+		})
+		write(uint32(len(contexts)))
+		for _, context := range contexts {
+			write(context[:])
+			write(model.Counts[i][context])
+		}
+	}
+	return err
+}
+
+// SaveModel saves a markov model to a file
+func SaveModel(path string, model *Model) error {
+	output, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	writer := bufio.NewWriter(output)
+	if err := WriteModel(writer, model); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return output.Close()
+}
+
+// OrderStats are statistics of one order of a markov model
+type OrderStats struct {
+	// Contexts is the number of distinct contexts
+	Contexts int
+	// FanOut is the average number of distinct next bytes of a context
+	FanOut float64
+	// Entropy is the entropy in bits of the next byte distribution summed over the contexts
+	Entropy float64
+	// Conditional is the entropy in bits of the next byte given the context
+	Conditional float64
+}
+
+// ModelStats computes the statistics of each order of a markov model
+func ModelStats(model *Model) [order]OrderStats {
+	var stats [order]OrderStats
+	for i := range model.Counts {
+		var totals [256]uint64
+		total, next := uint64(0), 0
+		conditional := 0.0
+		for _, vector := range model.Counts[i] {
+			sum := uint64(0)
+			for symbol, count := range vector {
+				if count > 0 {
+					next++
+					totals[symbol] += uint64(count)
+					sum += uint64(count)
+				}
+			}
+			// sum*log2(sum) - sum of count*log2(count) is sum times the entropy of the context
+			conditional += float64(sum) * math.Log2(float64(sum))
+			for _, count := range vector {
+				if count > 0 {
+					conditional -= float64(count) * math.Log2(float64(count))
+				}
+			}
+			total += sum
+		}
+		stats[i].Contexts = len(model.Counts[i])
+		if stats[i].Contexts > 0 {
+			stats[i].FanOut = float64(next) / float64(stats[i].Contexts)
+		}
+		if total > 0 {
+			stats[i].Conditional = conditional / float64(total)
+		}
+		for _, count := range totals {
+			if count > 0 {
+				p := float64(count) / float64(total)
+				stats[i].Entropy -= p * math.Log2(p)
+			}
+		}
+	}
+	return stats
+}
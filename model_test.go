@@ -0,0 +1,44 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveModelDeterministic(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "pattern", data: Synthetic(SelfTestPattern, SelfTestBytes)},
+		{name: "resets", data: []byte("abracadabra\nabra\ncadabra")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var saved [2][]byte
+			for i := range saved {
+				// the models are built independently so that the order of their maps differs
+				model := NewModel(test.data)
+				path := filepath.Join(t.TempDir(), "model.bin")
+				if err := SaveModel(path, &model); err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				saved[i] = data
+			}
+			if !bytes.Equal(saved[0], saved[1]) {
+				t.Errorf("two models built from the same data saved different files of %d and %d bytes", len(saved[0]), len(saved[1]))
+			}
+		})
+	}
+}
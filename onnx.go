@@ -0,0 +1,256 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+
+	"github.com/pointlander/gradient/tf64"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// ONNXIRVersion is the ir version of the exported onnx model
+	ONNXIRVersion = 7
+	// ONNXOpset is the version of the default operator set of the exported onnx model
+	ONNXOpset = 13
+	// ONNXFloat is the float element type of onnx tensors
+	ONNXFloat = 1
+	// ONNXAttributeInt is the int type of onnx attributes
+	ONNXAttributeInt = 2
+)
+
+// onnxString appends a string or bytes field
+func onnxString(b []byte, field protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// onnxInt appends an integer field
+func onnxInt(b []byte, field protowire.Number, value int64) []byte {
+	b = protowire.AppendTag(b, field, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(value))
+}
+
+// onnxTensor encodes a float tensor initializer, the values are stored as little endian float32
+func onnxTensor(name string, values []float64, dims ...int) []byte {
+	var tensor []byte
+	for _, dim := range dims {
+		tensor = onnxInt(tensor, 1, int64(dim))
+	}
+	tensor = onnxInt(tensor, 2, ONNXFloat)
+	tensor = onnxString(tensor, 8, []byte(name))
+	raw := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(raw[4*i:], math.Float32bits(float32(value)))
+	}
+	return onnxString(tensor, 9, raw)
+}
+
+// onnxValueInfo encodes the name, element type, and shape of a graph input or output
+func onnxValueInfo(name string, dims ...int) []byte {
+	var shape []byte
+	for _, dim := range dims {
+		shape = onnxString(shape, 1, onnxInt(nil, 1, int64(dim)))
+	}
+	tensor := onnxInt(nil, 1, ONNXFloat)
+	tensor = onnxString(tensor, 2, shape)
+	info := onnxString(nil, 1, []byte(name))
+	return onnxString(info, 2, onnxString(nil, 1, tensor))
+}
+
+// onnxNode encodes a node, ints are int attributes
+func onnxNode(op string, inputs, outputs []string, ints map[string]int64) []byte {
+	var node []byte
+	for _, input := range inputs {
+		node = onnxString(node, 1, []byte(input))
+	}
+	for _, output := range outputs {
+		node = onnxString(node, 2, []byte(output))
+	}
+	node = onnxString(node, 3, []byte(outputs[0]))
+	node = onnxString(node, 4, []byte(op))
+	for name, value := range ints {
+		attribute := onnxString(nil, 1, []byte(name))
+		attribute = onnxInt(attribute, 3, value)
+		attribute = onnxInt(attribute, 20, ONNXAttributeInt)
+		node = onnxString(node, 5, attribute)
+	}
+	return node
+}
+
+// ONNX encodes the shared auto encoder as an onnx model that maps the input to its reconstruction:
+// linear, activation, linear. The loss of a symbol is the sum of the squared differences between the output and the
+// markov features at the start of the input. The everett activation isn't an onnx operator, it is decomposed into
+// Min(x, 0) and Relu(x) concatenated, and the columns of l2 are reordered from the interleaved halves of everett to match.
+func ONNX(a *Auto, activation string) ([]byte, error) {
+	l1, b1, l2, b2 := a.Set.ByName["l1"], a.Set.ByName["b1"], a.Set.ByName["l2"], a.Set.ByName["b2"]
+	if l1 == nil || b1 == nil || b2 == nil {
+		return nil, fmt.Errorf("the auto encoder doesn't have the l1, b1, and b2 weights")
+	}
+	if l2 == nil {
+		// tied weights are exported as the transpose of l1
+		l2 = &tf64.V{S: []int{l1.S[1], l1.S[0]}, X: make([]float64, len(l1.X))}
+		for row := range l1.S[1] {
+			for column := range l1.S[0] {
+				l2.X[column*l1.S[1]+row] = l1.X[row*l1.S[0]+column]
+			}
+		}
+	}
+	inputs, hidden, width, outputs := l1.S[0], l1.S[1], l2.S[0], l2.S[1]
+
+	var graph []byte
+	gemm := map[string]int64{"transB": 1}
+	graph = onnxString(graph, 1, onnxNode("Gemm", []string{"input", "l1", "b1"}, []string{"hidden"}, gemm))
+	weights := l2.X
+	switch activation {
+	case "everett":
+		if width != 2*hidden {
+			return nil, fmt.Errorf("l2 has %d inputs, everett needs %d", width, 2*hidden)
+		}
+		graph = onnxString(graph, 1, onnxNode("Min", []string{"hidden", "zero"}, []string{"negative"}, nil))
+		graph = onnxString(graph, 1, onnxNode("Relu", []string{"hidden"}, []string{"positive"}, nil))
+		graph = onnxString(graph, 1, onnxNode("Concat", []string{"negative", "positive"}, []string{"activation"},
+			map[string]int64{"axis": 1}))
+		weights = make([]float64, len(l2.X))
+		for row := range outputs {
+			for i := range hidden {
+				weights[row*width+i] = l2.X[row*width+2*i]
+				weights[row*width+hidden+i] = l2.X[row*width+2*i+1]
+			}
+		}
+	case "relu":
+		graph = onnxString(graph, 1, onnxNode("Relu", []string{"hidden"}, []string{"activation"}, nil))
+	case "tanh":
+		graph = onnxString(graph, 1, onnxNode("Tanh", []string{"hidden"}, []string{"activation"}, nil))
+	default:
+		return nil, fmt.Errorf("activation %q can't be exported to onnx", activation)
+	}
+	graph = onnxString(graph, 1, onnxNode("Gemm", []string{"activation", "l2", "b2"}, []string{"output"}, gemm))
+	graph = onnxString(graph, 2, []byte("auto"))
+	graph = onnxString(graph, 5, onnxTensor("l1", l1.X, hidden, inputs))
+	graph = onnxString(graph, 5, onnxTensor("b1", b1.X, hidden))
+	graph = onnxString(graph, 5, onnxTensor("l2", weights, outputs, width))
+	graph = onnxString(graph, 5, onnxTensor("b2", b2.X, outputs))
+	if activation == "everett" {
+		graph = onnxString(graph, 5, onnxTensor("zero", []float64{0}))
+	}
+	graph = onnxString(graph, 11, onnxValueInfo("input", 1, inputs))
+	graph = onnxString(graph, 12, onnxValueInfo("output", 1, outputs))
+
+	model := onnxInt(nil, 1, ONNXIRVersion)
+	model = onnxString(model, 2, []byte("auto"))
+	model = onnxString(model, 7, graph)
+	return onnxString(model, 8, onnxInt(nil, 2, ONNXOpset)), nil
+}
+
+// ExportONNX exports the shared auto encoder to an onnx file
+func ExportONNX(path string, a *Auto, activation string) error {
+	model, err := ONNX(a, activation)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, model, 0644)
+}
+
+// onnxFields parses the fields of a message, the values of bytes fields are returned by field number
+func onnxFields(message []byte) (map[protowire.Number][][]byte, error) {
+	fields := make(map[protowire.Number][][]byte)
+	for len(message) > 0 {
+		number, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		message = message[n:]
+		if typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(message)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			fields[number] = append(fields[number], value)
+			message = message[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(number, typ, message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		message = message[n:]
+	}
+	return fields, nil
+}
+
+// CheckONNX checks that an onnx model encoded by ONNX is well formed and that the shapes of its initializers are
+// consistent with their data and with the weights of the auto encoder
+func CheckONNX(model []byte, a *Auto) error {
+	fields, err := onnxFields(model)
+	if err != nil {
+		return err
+	}
+	if len(fields[7]) != 1 {
+		return fmt.Errorf("the onnx model has %d graphs", len(fields[7]))
+	}
+	graph, err := onnxFields(fields[7][0])
+	if err != nil {
+		return err
+	}
+	if len(graph[1]) == 0 || len(graph[11]) != 1 || len(graph[12]) != 1 {
+		return fmt.Errorf("the onnx graph has %d nodes, %d inputs, and %d outputs", len(graph[1]), len(graph[11]), len(graph[12]))
+	}
+	for _, initializer := range graph[5] {
+		var dims []int
+		size := 1
+		for message := initializer; len(message) > 0; {
+			number, typ, n := protowire.ConsumeTag(message)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			message = message[n:]
+			if number == 1 && typ == protowire.VarintType {
+				dim, n := protowire.ConsumeVarint(message)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				dims = append(dims, int(dim))
+				size *= int(dim)
+				message = message[n:]
+				continue
+			}
+			n = protowire.ConsumeFieldValue(number, typ, message)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			message = message[n:]
+		}
+		tensor, err := onnxFields(initializer)
+		if err != nil {
+			return err
+		}
+		if len(tensor[8]) != 1 || len(tensor[9]) != 1 {
+			return fmt.Errorf("an onnx initializer doesn't have a name and raw data")
+		}
+		name := string(tensor[8][0])
+		if len(tensor[9][0]) != 4*size {
+			return fmt.Errorf("onnx initializer %s has %d bytes for shape %v", name, len(tensor[9][0]), dims)
+		}
+		w := a.Set.ByName[name]
+		if w == nil {
+			continue
+		}
+		// a matrix is stored with its rows first and a bias is a vector
+		expected := []int{w.S[1], w.S[0]}
+		if w.S[1] == 1 {
+			expected = []int{w.S[0]}
+		}
+		if !slices.Equal(dims, expected) {
+			return fmt.Errorf("onnx initializer %s has shape %v for weight shape %v", name, dims, w.S)
+		}
+	}
+	return nil
+}
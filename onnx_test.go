@@ -0,0 +1,57 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportONNX(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]string
+	}{
+		{name: "everett", flags: map[string]string{"activation": "everett"}},
+		{name: "relu", flags: map[string]string{"activation": "relu"}},
+		{name: "tanh", flags: map[string]string{"activation": "tanh"}},
+		{name: "pos", flags: map[string]string{"activation": "everett", "pos": "true"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "hidden", "8")
+			setFlag(t, "shared", "true")
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			rng := rand.New(rand.NewSource(1))
+			autos := NewAutos(nil, rng)
+			data := Synthetic(SelfTestPattern, 256)
+			model := NewModel(data)
+			if err := Train(autos, &model, data, nil, rng); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "auto.onnx")
+			if err := ExportONNX(path, &autos[0], *FlagActivation); err != nil {
+				t.Fatal(err)
+			}
+			exported, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := CheckONNX(exported, &autos[0]); err != nil {
+				t.Error(err)
+			}
+
+			// the check compares the shapes with the weights of the auto encoder
+			setFlag(t, "hidden", "16")
+			if err := CheckONNX(exported, &NewAutos(nil, rng)[0]); err == nil {
+				t.Error("the model of an auto encoder with 8 hidden units checks against one with 16")
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// Options are the options loaded from a config file by the name of their flag, every flag is an option so that the
+// options can't drift from the flags
+type Options map[string]json.RawMessage
+
+// LoadOptions loads options from a json config file, an option that isn't a flag is an error
+func LoadOptions(path string) (Options, error) {
+	var options Options
+	input, err := os.Open(path)
+	if err != nil {
+		return options, err
+	}
+	defer input.Close()
+	if err := json.NewDecoder(input).Decode(&options); err != nil {
+		return options, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(options)) {
+		if flag.Lookup(name) == nil {
+			return options, fmt.Errorf("%s: unknown option %q", path, name)
+		}
+	}
+	return options, nil
+}
+
+// Value is the flag value of an option, a json string, number, or bool
+func (o Options) Value(name string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(o[name]))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", fmt.Errorf("%s is not a string, number, or bool", o[name])
+}
+
+// Apply sets the flags of the flag set from the options, flags set on the command line take precedence and options
+// that aren't flags of the flag set are ignored
+func (o Options) Apply(set *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	set.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, name := range slices.Sorted(maps.Keys(o)) {
+		if explicit[name] || set.Lookup(name) == nil {
+			continue
+		}
+		value, err := o.Value(name)
+		if err == nil {
+			err = set.Set(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("option %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:   "every kind of flag",
+			config: `{"eta": 0.01, "hidden": 128, "freeze": "0-31", "shared": true, "maxtime": "1m", "trainbytes": 262144}`,
+			want: map[string]string{"eta": "0.01", "hidden": "128", "freeze": "0-31", "shared": "true", "maxtime": "1m0s",
+				"trainbytes": "262144"},
+		},
+		{
+			name:   "command line takes precedence",
+			config: `{"eta": 0.01, "hidden": 128}`,
+			args:   []string{"-hidden", "64"},
+			want:   map[string]string{"eta": "0.01", "hidden": "64"},
+		},
+		{
+			name:   "flags of other commands are ignored",
+			config: `{"n": 100, "hidden": 128}`,
+			want:   map[string]string{"n": "33", "hidden": "128"},
+		},
+		{
+			name:    "unknown option",
+			config:  `{"etaa": 0.01}`,
+			wantErr: `unknown option "etaa"`,
+		},
+		{
+			name:    "value of the wrong type",
+			config:  `{"hidden": "wide"}`,
+			wantErr: "option hidden",
+		},
+		{
+			name:    "value that isn't a scalar",
+			config:  `{"hidden": [128]}`,
+			wantErr: "not a string, number, or bool",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			command := Command{Name: "train", Flags: []string{"eta", "hidden", "freeze", "shared", "maxtime", "trainbytes"}}
+			for _, name := range append(command.Flags, "n") {
+				restoreFlag(t, name)
+			}
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			set := command.FlagSet()
+			if err := set.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			options, err := LoadOptions(path)
+			if err == nil {
+				err = options.Apply(set)
+			}
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range test.want {
+				if got := flag.Lookup(name).Value.String(); got != want {
+					t.Errorf("%s is %s, want %s", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 The Auto Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	// SelfTestPattern is the repeating pattern of the synthetic corpus
+	SelfTestPattern = "0123456789"
+	// SelfTestBytes is the size of the synthetic corpus
+	SelfTestBytes = 4 * 1024
+	// SelfTestContexts is the number of contexts of the synthetic corpus that predictions are checked on
+	SelfTestContexts = 100
+	// SelfTestFactor is how many times more probable than chance the next symbol of the pattern must be predicted
+	// and generated, chance is picking uniformly from the symbols of the pattern
+	SelfTestFactor = 2
+	// SelfTestRestarts is the number of generations from the contexts of the synthetic corpus that the pattern
+	// accuracy of generation is averaged over
+	SelfTestRestarts = 512
+)
+
+// Synthetic generates a deterministic corpus that repeats a pattern
+func Synthetic(pattern string, size int) []byte {
+	return bytes.Repeat([]byte(pattern), size/len(pattern)+1)[:size]
+}
+
+// PatternAccuracy is the fraction of transitions in data that follow the pattern
+func PatternAccuracy(pattern string, data []byte) float64 {
+	if len(data) < 2 {
+		return 0
+	}
+	correct := 0
+	for i := 1; i < len(data); i++ {
+		index := bytes.IndexByte([]byte(pattern), data[i-1])
+		if index >= 0 && pattern[(index+1)%len(pattern)] == data[i] {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(data)-1)
+}
+
+// PatternProbability is the average probability predicted for the next symbol over the contexts of data
+func PatternProbability(autos []Auto, model *Model, data []byte) float64 {
+	context := NewContext()
+	sum := 0.0
+	for i, value := range data {
+		if i > 0 {
+			sum += Predict(autos, &context, model)[value]
+		}
+		context.Observe(value)
+	}
+	if len(data) < 2 {
+		return 0
+	}
+	return sum / float64(len(data)-1)
+}
+
+// SelfTest builds a markov model from a synthetic corpus, trains the auto encoders of the symbols of the pattern on
+// it, and checks that the pattern is predicted and generated well above chance. Chance is over the symbols of the
+// pattern, so auto encoders that only learned which symbols occur don't pass. A generation that leaves the pattern
+// continues from contexts that were never seen, so generation is checked with a byte generated from each of many
+// contexts of the corpus.
+func SelfTest() error {
+	rng := rand.New(rand.NewSource(1))
+	data := Synthetic(SelfTestPattern, SelfTestBytes)
+	model := NewModel(data)
+	autos := NewAutos([]byte(SelfTestPattern), rng)
+	if err := Train(autos, &model, data, nil, rng); err != nil {
+		return err
+	}
+	chance := 1.0 / float64(len(SelfTestPattern))
+	accuracy := 0.0
+	for i := range SelfTestRestarts {
+		prompt := data[:i+1]
+		generated, _ := Generate(autos, nil, &model, prompt, 1, Recorder{}, rng)
+		accuracy += PatternAccuracy(SelfTestPattern, generated[len(prompt)-1:])
+	}
+	accuracy /= SelfTestRestarts
+	fmt.Fprintf(Stdout, "self test generates the pattern with accuracy %f over %d generations, chance is %f\n",
+		accuracy, SelfTestRestarts, chance)
+	if accuracy < SelfTestFactor*chance {
+		return fmt.Errorf("self test failed: the pattern is generated with accuracy %f, expected at least %f",
+			accuracy, SelfTestFactor*chance)
+	}
+
+	probability := PatternProbability(autos, &model, data[:SelfTestContexts])
+	fmt.Fprintf(Stdout, "self test predicts the pattern with probability %f, chance is %f\n", probability, chance)
+	if probability < SelfTestFactor*chance {
+		return fmt.Errorf("self test failed: the pattern is predicted with probability %f, expected at least %f",
+			probability, SelfTestFactor*chance)
+	}
+	return nil
+}